@@ -0,0 +1,443 @@
+// Package api serves the versioned JSON API under /api/v1.
+package api
+
+import (
+	"demo/chat"
+	"demo/lifecycle"
+	"demo/persona"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// maxBodySize limits the size of request bodies.
+const maxBodySize = 1 << 20
+
+var errPromptNotRunning = errors.New("prompt is not being answered")
+
+// requestError is a request the API rejects before calling a service.
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// invalid reports a request body or parameter that fails validation.
+func invalid(message string) error {
+	return &requestError{status: http.StatusBadRequest, code: "invalid_request", message: message}
+}
+
+// validator is implemented by request bodies that check their own fields.
+type validator interface {
+	validate() error
+}
+
+// route describes an endpoint of the API, both to serve it and to document it.
+type route struct {
+	method           string
+	path             string
+	id               string // OpenAPI operation ID
+	summary          string
+	query            []queryParam
+	request          any  // zero value of the request body, nil if there is none
+	optionalRequest  bool // the request body may be left out
+	response         any  // zero value of the response body, nil if there is none
+	status           int  // status of a successful response
+	handle           func(r *http.Request) (any, error)
+	startsGeneration bool // refused with 503 while the server shuts down
+}
+
+// queryParam documents an optional query parameter.
+type queryParam struct {
+	name    string
+	summary string
+	enum    []string
+}
+
+// API serves chats, prompts, responses and settings as JSON.
+type API struct {
+	chatService *chat.ChatService
+	lc          *lifecycle.Manager
+	routes      []route
+}
+
+// New creates the API on top of the chat service. Requests starting
+// generations are refused once lc begins shutting down.
+func New(chatService *chat.ChatService, lc *lifecycle.Manager) *API {
+	a := &API{
+		chatService: chatService,
+		lc:          lc,
+	}
+	a.routes = a.defineRoutes()
+	return a
+}
+
+// Handler returns the handler serving the API, meant to be mounted at /api/v1.
+func (a *API) Handler() http.Handler {
+	r := chi.NewRouter()
+	for _, rt := range a.routes {
+		r.Method(rt.method, rt.path, a.serve(rt))
+	}
+
+	document, err := json.MarshalIndent(a.openAPI(), "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode the OpenAPI document: %v", err)
+	}
+	r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	})
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, &requestError{status: http.StatusNotFound, code: "not_found", message: "no such endpoint"})
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, &requestError{status: http.StatusMethodNotAllowed, code: "method_not_allowed", message: "method not allowed"})
+	})
+	return r
+}
+
+// serve adapts a route's handler to HTTP, encoding its result or error as JSON.
+func (a *API) serve(rt route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rt.startsGeneration && a.lc.IsShuttingDown() {
+			writeError(w, &requestError{status: http.StatusServiceUnavailable, code: "shutting_down", message: "server is shutting down"})
+			return
+		}
+
+		body, err := rt.handle(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if body == nil {
+			w.WriteHeader(rt.status)
+			return
+		}
+		writeJSON(w, rt.status, body)
+	}
+}
+
+// decode reads a JSON request body into v and validates it.
+func decode(r *http.Request, v any) error {
+	return decodeBody(r, v, true)
+}
+
+// decodeOptional is decode for request bodies that may be left out.
+func decodeOptional(r *http.Request, v any) error {
+	return decodeBody(r, v, false)
+}
+
+func decodeBody(r *http.Request, v any, required bool) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) && !required {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			return invalid("request body is required")
+		}
+		return invalid(fmt.Sprintf("invalid request body: %v", err))
+	}
+	if decoder.More() {
+		return invalid("request body must be a single JSON value")
+	}
+	if v, ok := v.(validator); ok {
+		return v.validate()
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes the error body matching err. Errors the API does not
+// know are logged and reported without details.
+func writeError(w http.ResponseWriter, err error) {
+	status, code, message := http.StatusInternalServerError, "internal_error", "internal server error"
+
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		status, code, message = reqErr.status, reqErr.code, reqErr.message
+	case errors.Is(err, chat.ErrChatNotFound):
+		status, code, message = http.StatusNotFound, "chat_not_found", err.Error()
+	case errors.Is(err, chat.ErrPromptNotFound):
+		status, code, message = http.StatusNotFound, "prompt_not_found", err.Error()
+	case errors.Is(err, chat.ErrResponseNotFound):
+		status, code, message = http.StatusNotFound, "response_not_found", err.Error()
+	case errors.Is(err, persona.ErrPersonaNotFound):
+		status, code, message = http.StatusNotFound, "persona_not_found", err.Error()
+	case errors.Is(err, chat.ErrPromptBusy):
+		status, code, message = http.StatusConflict, "prompt_busy", err.Error()
+	case errors.Is(err, errPromptNotRunning):
+		status, code, message = http.StatusConflict, "prompt_not_running", err.Error()
+	case errors.Is(err, chat.ErrChatDeleted):
+		status, code, message = http.StatusConflict, "chat_deleted", err.Error()
+	case errors.Is(err, chat.ErrChatNotDeleted):
+		status, code, message = http.StatusConflict, "chat_not_deleted", err.Error()
+	case errors.Is(err, chat.ErrNameRequired):
+		status, code, message = http.StatusBadRequest, "invalid_request", err.Error()
+	default:
+		log.Printf("API request failed: %v\n", err)
+	}
+
+	writeJSON(w, status, Error{Error: ErrorDetail{Code: code, Message: message}})
+}
+
+// defineRoutes lists the endpoints of the API.
+func (a *API) defineRoutes() []route {
+	return []route{
+		{
+			method: http.MethodGet, path: "/chats", id: "listChats", summary: "List chats, most recently updated first",
+			query:    []queryParam{{name: "view", summary: "which chats to list; active by default", enum: []string{"active", "archived", "trash"}}},
+			response: []ChatSummary{}, status: http.StatusOK, handle: a.listChats,
+		},
+		{
+			method: http.MethodPost, path: "/chats", id: "createChat", summary: "Create a chat",
+			request: CreateChatRequest{}, response: Chat{}, status: http.StatusCreated, handle: a.createChat,
+		},
+		{
+			method: http.MethodGet, path: "/chats/{chatId}", id: "getChat", summary: "Get a chat with its prompts and responses",
+			response: Chat{}, status: http.StatusOK, handle: a.getChat,
+		},
+		{
+			method: http.MethodPatch, path: "/chats/{chatId}", id: "updateChat", summary: "Rename, archive or unarchive a chat",
+			request: UpdateChatRequest{}, response: Chat{}, status: http.StatusOK, handle: a.updateChat,
+		},
+		{
+			method: http.MethodDelete, path: "/chats/{chatId}", id: "deleteChat", summary: "Move a chat to the trash",
+			status: http.StatusNoContent, handle: a.deleteChat,
+		},
+		{
+			method: http.MethodPost, path: "/chats/{chatId}/restore", id: "restoreChat", summary: "Take a chat back out of the trash",
+			response: Chat{}, status: http.StatusOK, handle: a.restoreChat,
+		},
+		{
+			method: http.MethodGet, path: "/chats/{chatId}/settings", id: "getSettings", summary: "Get the generation settings of a chat",
+			response: chat.Settings{}, status: http.StatusOK, handle: a.getSettings,
+		},
+		{
+			method: http.MethodPut, path: "/chats/{chatId}/settings", id: "updateSettings", summary: "Replace the generation settings of a chat",
+			request: chat.Settings{}, response: chat.Settings{}, status: http.StatusOK, handle: a.updateSettings,
+		},
+		{
+			method: http.MethodPost, path: "/chats/{chatId}/prompts", id: "submitPrompt", summary: "Submit a prompt; it is answered in the background",
+			request: SubmitPromptRequest{}, response: Prompt{}, status: http.StatusAccepted, handle: a.submitPrompt, startsGeneration: true,
+		},
+		{
+			method: http.MethodGet, path: "/chats/{chatId}/prompts/{promptId}", id: "getPrompt", summary: "Get a prompt with its status and responses",
+			response: Prompt{}, status: http.StatusOK, handle: a.getPrompt,
+		},
+		{
+			method: http.MethodPost, path: "/chats/{chatId}/prompts/{promptId}/stop", id: "stopPrompt", summary: "Stop answering a prompt",
+			status: http.StatusAccepted, handle: a.stopPrompt,
+		},
+		{
+			method: http.MethodPost, path: "/chats/{chatId}/prompts/{promptId}/regenerate", id: "regeneratePrompt", summary: "Answer a prompt again, keeping the earlier responses",
+			request: RegenerateRequest{}, optionalRequest: true, response: Prompt{}, status: http.StatusAccepted, handle: a.regeneratePrompt, startsGeneration: true,
+		},
+		{
+			method: http.MethodGet, path: "/chats/{chatId}/prompts/{promptId}/responses", id: "listResponses", summary: "List the responses to a prompt, oldest first",
+			response: []Response{}, status: http.StatusOK, handle: a.listResponses,
+		},
+		{
+			method: http.MethodPut, path: "/chats/{chatId}/prompts/{promptId}/preferred-response", id: "preferResponse", summary: "Choose the response used as the answer in the chat history",
+			request: PreferResponseRequest{}, response: Prompt{}, status: http.StatusOK, handle: a.preferResponse,
+		},
+	}
+}
+
+func (a *API) listChats(r *http.Request) (any, error) {
+	var chats []chat.Chat
+	var err error
+	switch view := r.URL.Query().Get("view"); view {
+	case "", "active":
+		chats, err = a.chatService.ListChats()
+	case "archived":
+		chats, err = a.chatService.ListArchivedChats()
+	case "trash":
+		chats, err = a.chatService.ListDeletedChats()
+	default:
+		return nil, invalid(fmt.Sprintf("unknown view %q", view))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]ChatSummary, 0, len(chats))
+	for _, c := range chats {
+		summaries = append(summaries, toChatSummary(c))
+	}
+	return summaries, nil
+}
+
+func (a *API) createChat(r *http.Request) (any, error) {
+	var req CreateChatRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+
+	chatID, err := a.chatService.CreateChat(strings.TrimSpace(req.Name), req.PersonaID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Settings != nil {
+		if err := a.chatService.UpdateSettings(chatID, *req.Settings); err != nil {
+			return nil, err
+		}
+	}
+	return a.chat(chatID)
+}
+
+func (a *API) getChat(r *http.Request) (any, error) {
+	return a.chat(chi.URLParam(r, "chatId"))
+}
+
+// chat returns the representation of a chat.
+func (a *API) chat(chatID string) (any, error) {
+	c, err := a.chatService.GetChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return toChat(c), nil
+}
+
+func (a *API) updateChat(r *http.Request) (any, error) {
+	chatID := chi.URLParam(r, "chatId")
+	var req UpdateChatRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+
+	if req.Name != nil {
+		if err := a.chatService.RenameChat(chatID, *req.Name); err != nil {
+			return nil, err
+		}
+	}
+	if req.Archived != nil {
+		if err := a.chatService.ArchiveChat(chatID, *req.Archived); err != nil {
+			return nil, err
+		}
+	}
+	return a.chat(chatID)
+}
+
+func (a *API) deleteChat(r *http.Request) (any, error) {
+	return nil, a.chatService.DeleteChat(chi.URLParam(r, "chatId"))
+}
+
+func (a *API) restoreChat(r *http.Request) (any, error) {
+	chatID := chi.URLParam(r, "chatId")
+	if err := a.chatService.RestoreChat(chatID); err != nil {
+		return nil, err
+	}
+	return a.chat(chatID)
+}
+
+func (a *API) getSettings(r *http.Request) (any, error) {
+	return a.chatService.GetSettings(chi.URLParam(r, "chatId"))
+}
+
+func (a *API) updateSettings(r *http.Request) (any, error) {
+	chatID := chi.URLParam(r, "chatId")
+	var settings chat.Settings
+	if err := decode(r, &settings); err != nil {
+		return nil, err
+	}
+	if err := validateSettings(settings); err != nil {
+		return nil, err
+	}
+
+	if err := a.chatService.UpdateSettings(chatID, settings); err != nil {
+		return nil, err
+	}
+	return a.chatService.GetSettings(chatID)
+}
+
+func (a *API) submitPrompt(r *http.Request) (any, error) {
+	chatID := chi.URLParam(r, "chatId")
+	var req SubmitPromptRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+
+	p, err := a.chatService.SubmitPrompt(chatID, req.Text)
+	if err != nil {
+		return nil, err
+	}
+	return toPrompt(*p), nil
+}
+
+func (a *API) getPrompt(r *http.Request) (any, error) {
+	p, err := a.chatService.GetPrompt(chi.URLParam(r, "chatId"), chi.URLParam(r, "promptId"))
+	if err != nil {
+		return nil, err
+	}
+	return toPrompt(p), nil
+}
+
+func (a *API) stopPrompt(r *http.Request) (any, error) {
+	p, err := a.chatService.GetPrompt(chi.URLParam(r, "chatId"), chi.URLParam(r, "promptId"))
+	if err != nil {
+		return nil, err
+	}
+	if !p.Busy() {
+		return nil, errPromptNotRunning
+	}
+
+	a.chatService.RequestStop(p.Id())
+	return nil, nil
+}
+
+func (a *API) regeneratePrompt(r *http.Request) (any, error) {
+	chatID, promptID := chi.URLParam(r, "chatId"), chi.URLParam(r, "promptId")
+	var req RegenerateRequest
+	if err := decodeOptional(r, &req); err != nil {
+		return nil, err
+	}
+
+	var overrides chat.Settings
+	if req.Settings != nil {
+		overrides = *req.Settings
+	}
+	if err := a.chatService.RegeneratePrompt(chatID, promptID, overrides); err != nil {
+		return nil, err
+	}
+	return a.getPrompt(r)
+}
+
+func (a *API) listResponses(r *http.Request) (any, error) {
+	p, err := a.chatService.GetPrompt(chi.URLParam(r, "chatId"), chi.URLParam(r, "promptId"))
+	if err != nil {
+		return nil, err
+	}
+	return toResponses(p.Responses()), nil
+}
+
+func (a *API) preferResponse(r *http.Request) (any, error) {
+	var req PreferResponseRequest
+	if err := decode(r, &req); err != nil {
+		return nil, err
+	}
+
+	err := a.chatService.SetPreferredResponse(chi.URLParam(r, "chatId"), chi.URLParam(r, "promptId"), req.ResponseID)
+	if err != nil {
+		return nil, err
+	}
+	return a.getPrompt(r)
+}
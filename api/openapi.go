@@ -0,0 +1,181 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pathParam matches the parameters of a route path such as {chatId}.
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPI generates the OpenAPI 3 document describing the routes. Schemas
+// are derived from the request and response types: JSON tags name the
+// properties, fields without omitempty are required, and the doc and enum
+// tags add a description and the allowed values.
+func (a *API) openAPI() map[string]any {
+	schemas := map[string]any{}
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(Error{}), schemas)},
+		},
+	}
+
+	paths := map[string]any{}
+	for _, rt := range a.routes {
+		operation := map[string]any{
+			"operationId": rt.id,
+			"summary":     rt.summary,
+		}
+
+		var parameters []any
+		for _, match := range pathParam.FindAllStringSubmatch(rt.path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range rt.query {
+			schema := map[string]any{"type": "string"}
+			if len(q.enum) > 0 {
+				schema["enum"] = q.enum
+			}
+			parameters = append(parameters, map[string]any{
+				"name":        q.name,
+				"in":          "query",
+				"description": q.summary,
+				"schema":      schema,
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if rt.request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": !rt.optionalRequest,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(rt.request), schemas)},
+				},
+			}
+		}
+
+		success := map[string]any{"description": http.StatusText(rt.status)}
+		if rt.response != nil {
+			success["content"] = map[string]any{
+				"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(rt.response), schemas)},
+			}
+		}
+		operation["responses"] = map[string]any{
+			strconv.Itoa(rt.status): success,
+			"default":               errorResponse,
+		}
+
+		item, ok := paths[rt.path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[rt.path] = item
+		}
+		item[strings.ToLower(rt.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Chat API",
+			"version": "1",
+		},
+		"servers":    []any{map[string]any{"url": "/api/v1"}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+// schemaOf returns the schema of a type. Named structs are added to schemas
+// once and referenced.
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exists := schemas[t.Name()]; !exists {
+			schemas[t.Name()] = nil // placeholder for recursive types
+			properties := map[string]any{}
+			var required []string
+			addProperties(t, properties, &required, schemas)
+			schema := map[string]any{"type": "object", "properties": properties}
+			if len(required) > 0 {
+				schema["required"] = required
+			}
+			schemas[t.Name()] = schema
+		}
+		return ref
+	}
+	return map[string]any{}
+}
+
+// addProperties adds the JSON properties of a struct's fields, including the
+// fields of embedded structs.
+func addProperties(t reflect.Type, properties map[string]any, required *[]string, schemas map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addProperties(field.Type, properties, required, schemas)
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := schemaOf(field.Type, schemas)
+		if doc := field.Tag.Get("doc"); doc != "" || field.Tag.Get("enum") != "" {
+			// $ref siblings are ignored, so annotated references are wrapped
+			if _, isRef := schema["$ref"]; isRef {
+				schema = map[string]any{"allOf": []any{schema}}
+			}
+			if doc != "" {
+				schema["description"] = doc
+			}
+			if enum := field.Tag.Get("enum"); enum != "" {
+				schema["enum"] = strings.Split(enum, ",")
+			}
+		}
+		properties[name] = schema
+
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"demo/chat"
+	"strings"
+	"time"
+)
+
+// ChatSummary describes a chat without its prompts.
+type ChatSummary struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	PersonaID   string     `json:"personaId,omitempty"`
+	Archived    bool       `json:"archived"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"`
+	PromptCount int        `json:"promptCount"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+// Chat is a chat with its settings and every prompt.
+type Chat struct {
+	ChatSummary
+	Settings chat.Settings `json:"settings"`
+	Prompts  []Prompt      `json:"prompts"`
+}
+
+// Prompt is a prompt with its alternative responses, oldest first.
+type Prompt struct {
+	ID                  string            `json:"id"`
+	Text                string            `json:"text"`
+	Status              chat.PromptStatus `json:"status" enum:"pending,generating,completed,failed,cancelled"`
+	Settings            *chat.Settings    `json:"settings,omitempty" doc:"settings overriding the chat's when the prompt was regenerated"`
+	PreferredResponseID string            `json:"preferredResponseId,omitempty" doc:"the response used as the answer; the latest one if empty"`
+	Responses           []Response        `json:"responses"`
+	CreatedAt           time.Time         `json:"createdAt"`
+}
+
+// Response is one answer to a prompt.
+type Response struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CreateChatRequest creates a chat, optionally with a persona and settings.
+type CreateChatRequest struct {
+	Name      string         `json:"name"`
+	PersonaID string         `json:"personaId,omitempty" doc:"the chat starts from the persona's default settings"`
+	Settings  *chat.Settings `json:"settings,omitempty" doc:"replaces the persona's default settings"`
+}
+
+// UpdateChatRequest renames, archives or unarchives a chat. Omitted fields are left unchanged.
+type UpdateChatRequest struct {
+	Name     *string `json:"name,omitempty"`
+	Archived *bool   `json:"archived,omitempty"`
+}
+
+// SubmitPromptRequest adds a prompt to a chat.
+type SubmitPromptRequest struct {
+	Text string `json:"text"`
+}
+
+// RegenerateRequest answers a prompt again, optionally with other settings.
+type RegenerateRequest struct {
+	Settings *chat.Settings `json:"settings,omitempty" doc:"fields set here replace the chat's settings for this prompt"`
+}
+
+// PreferResponseRequest chooses the response used as the answer to a prompt.
+type PreferResponseRequest struct {
+	ResponseID string `json:"responseId" doc:"empty to use the latest response"`
+}
+
+func (req CreateChatRequest) validate() error {
+	if strings.TrimSpace(req.Name) == "" {
+		return invalid("name is required")
+	}
+	if req.Settings != nil {
+		return validateSettings(*req.Settings)
+	}
+	return nil
+}
+
+func (req UpdateChatRequest) validate() error {
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		return invalid("name must not be empty")
+	}
+	if req.Name == nil && req.Archived == nil {
+		return invalid("name or archived is required")
+	}
+	return nil
+}
+
+func (req SubmitPromptRequest) validate() error {
+	if strings.TrimSpace(req.Text) == "" {
+		return invalid("text is required")
+	}
+	return nil
+}
+
+func (req RegenerateRequest) validate() error {
+	if req.Settings != nil {
+		return validateSettings(*req.Settings)
+	}
+	return nil
+}
+
+func validateSettings(settings chat.Settings) error {
+	if err := settings.Validate(); err != nil {
+		return invalid("settings: " + err.Error())
+	}
+	return nil
+}
+
+// Error is the body of every error response.
+type Error struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes what went wrong. Code is stable and meant for
+// programs, Message for people.
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func toChatSummary(c chat.Chat) ChatSummary {
+	summary := ChatSummary{
+		ID:          c.Id(),
+		Name:        c.Name(),
+		PersonaID:   c.PersonaID(),
+		Archived:    c.Archived(),
+		PromptCount: len(c.Prompts()),
+		CreatedAt:   c.CreatedAt(),
+		UpdatedAt:   c.UpdatedAt(),
+	}
+	if c.Deleted() {
+		deletedAt := c.DeletedAt()
+		summary.DeletedAt = &deletedAt
+	}
+	return summary
+}
+
+func toChat(c chat.Chat) Chat {
+	result := Chat{
+		ChatSummary: toChatSummary(c),
+		Settings:    c.Settings(),
+		Prompts:     make([]Prompt, 0, len(c.Prompts())),
+	}
+	for _, prompt := range c.Prompts() {
+		result.Prompts = append(result.Prompts, toPrompt(prompt))
+	}
+	return result
+}
+
+func toPrompt(p chat.Prompt) Prompt {
+	return Prompt{
+		ID:                  p.Id(),
+		Text:                p.Text(),
+		Status:              p.Status(),
+		Settings:            p.Settings(),
+		PreferredResponseID: p.PreferredResponseId(),
+		Responses:           toResponses(p.Responses()),
+		CreatedAt:           p.CreatedAt(),
+	}
+}
+
+func toResponses(responses []chat.Response) []Response {
+	result := make([]Response, 0, len(responses))
+	for _, response := range responses {
+		result = append(result, Response{
+			ID:        response.Id(),
+			Text:      response.Text(),
+			CreatedAt: response.CreatedAt(),
+			UpdatedAt: response.UpdatedAt(),
+		})
+	}
+	return result
+}
@@ -0,0 +1,485 @@
+package chat
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket  = []byte("meta")
+	chatsBucket = []byte("chats")
+	// PersonasBucket holds the personas that the persona package stores in
+	// the same database as the chats.
+	PersonasBucket = []byte("personas")
+
+	schemaVersionKey = []byte("schema_version")
+)
+
+// migration upgrades the database schema by one version.
+type migration func(tx *bolt.Tx) error
+
+// migrations are applied in order; the schema version is the number applied so far.
+// Append new migrations to the end and never change one that has shipped.
+var migrations = []migration{
+	// 1: one JSON document per chat, keyed by chat ID.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(chatsBucket)
+		return err
+	},
+	// 2: responses used to be stored one per streamed token; merge them into a
+	// single assembled response per prompt.
+	func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(chatsBucket)
+		return bucket.ForEach(func(k, v []byte) error {
+			var record chatRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("decoding chat %s: %w", k, err)
+			}
+			for i, prompt := range record.Prompts {
+				if len(prompt.Responses) < 2 {
+					continue
+				}
+				merged := prompt.Responses[0]
+				for _, response := range prompt.Responses[1:] {
+					merged.Text += response.Text
+					merged.UpdatedAt = response.CreatedAt
+				}
+				record.Prompts[i].Responses = []responseRecord{merged}
+			}
+			data, err := json.Marshal(record)
+			if err != nil {
+				return fmt.Errorf("encoding chat %s: %w", k, err)
+			}
+			return bucket.Put(k, data)
+		})
+	},
+	// 3: personas, one JSON document each keyed by persona ID.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(PersonasBucket)
+		return err
+	},
+}
+
+// chatRecord is the stored form of a Chat.
+type chatRecord struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	PersonaID string         `json:"personaId,omitempty"`
+	Settings  Settings       `json:"settings"`
+	Prompts   []promptRecord `json:"prompts"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	Archived  bool           `json:"archived,omitempty"`
+	DeletedAt *time.Time     `json:"deletedAt,omitempty"`
+}
+
+// promptRecord is the stored form of a Prompt.
+type promptRecord struct {
+	ID                  string           `json:"id"`
+	Text                string           `json:"text"`
+	Status              PromptStatus     `json:"status"`
+	Settings            *Settings        `json:"settings,omitempty"`
+	Responses           []responseRecord `json:"responses"`
+	PreferredResponseID string           `json:"preferredResponseId,omitempty"`
+	CreatedAt           time.Time        `json:"createdAt"`
+	UpdatedAt           time.Time        `json:"updatedAt"`
+}
+
+// responseRecord is the stored form of a Response.
+type responseRecord struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func toChatRecord(chat *Chat) chatRecord {
+	record := chatRecord{
+		ID:        chat.id,
+		Name:      chat.name,
+		PersonaID: chat.personaID,
+		Settings:  chat.settings,
+		Prompts:   make([]promptRecord, 0, len(chat.prompts)),
+		CreatedAt: chat.createdAt,
+		UpdatedAt: chat.updatedAt,
+		Archived:  chat.archived,
+	}
+	if !chat.deletedAt.IsZero() {
+		record.DeletedAt = &chat.deletedAt
+	}
+	for _, prompt := range chat.prompts {
+		p := promptRecord{
+			ID:                  prompt.id,
+			Text:                prompt.text,
+			Status:              prompt.status,
+			Settings:            prompt.settings,
+			Responses:           make([]responseRecord, 0, len(prompt.responses)),
+			PreferredResponseID: prompt.preferredResponseId,
+			CreatedAt:           prompt.createdAt,
+			UpdatedAt:           prompt.updatedAt,
+		}
+		for _, response := range prompt.responses {
+			p.Responses = append(p.Responses, responseRecord{
+				ID:        response.id,
+				Text:      response.text,
+				CreatedAt: response.createdAt,
+				UpdatedAt: response.updatedAt,
+			})
+		}
+		record.Prompts = append(record.Prompts, p)
+	}
+	return record
+}
+
+func fromChatRecord(record chatRecord) *Chat {
+	chat := &Chat{
+		id:        record.ID,
+		name:      record.Name,
+		personaID: record.PersonaID,
+		settings:  record.Settings,
+		prompts:   make([]Prompt, 0, len(record.Prompts)),
+		createdAt: record.CreatedAt,
+		updatedAt: record.UpdatedAt,
+		archived:  record.Archived,
+	}
+	if record.DeletedAt != nil {
+		chat.deletedAt = *record.DeletedAt
+	}
+	for _, p := range record.Prompts {
+		prompt := Prompt{
+			id:                  p.ID,
+			text:                p.Text,
+			status:              p.Status,
+			settings:            p.Settings,
+			responses:           make([]Response, 0, len(p.Responses)),
+			preferredResponseId: p.PreferredResponseID,
+			createdAt:           p.CreatedAt,
+			updatedAt:           p.UpdatedAt,
+		}
+		for _, response := range p.Responses {
+			prompt.responses = append(prompt.responses, Response{
+				id:        response.ID,
+				text:      response.Text,
+				createdAt: response.CreatedAt,
+				updatedAt: response.UpdatedAt,
+			})
+		}
+		chat.prompts = append(chat.prompts, prompt)
+	}
+	return chat
+}
+
+// BoltRepository is a Repository that persists chats to a bbolt database file.
+type BoltRepository struct {
+	db *bolt.DB
+}
+
+// NewBoltRepository opens, creating if needed, the database at path and
+// migrates it to the latest schema.
+func NewBoltRepository(path string) (*BoltRepository, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening chat database: %w", err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltRepository{db: db}, nil
+}
+
+// migrate applies every migration newer than the stored schema version.
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if v := meta.Get(schemaVersionKey); v != nil {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("chat database schema version %d is newer than supported version %d", version, len(migrations))
+		}
+
+		for ; version < len(migrations); version++ {
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("migrating chat database to version %d: %w", version+1, err)
+			}
+		}
+
+		return meta.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, uint64(version)))
+	})
+}
+
+// getChat loads a chat inside a transaction.
+func getChat(tx *bolt.Tx, chatId string) (*Chat, error) {
+	data := tx.Bucket(chatsBucket).Get([]byte(chatId))
+	if data == nil {
+		return nil, ErrChatNotFound
+	}
+
+	var record chatRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("decoding chat %s: %w", chatId, err)
+	}
+	return fromChatRecord(record), nil
+}
+
+// putChat stores a chat inside a transaction.
+func putChat(tx *bolt.Tx, chat *Chat) error {
+	data, err := json.Marshal(toChatRecord(chat))
+	if err != nil {
+		return fmt.Errorf("encoding chat %s: %w", chat.id, err)
+	}
+	return tx.Bucket(chatsBucket).Put([]byte(chat.id), data)
+}
+
+// updateChat loads a chat, applies fn to it and stores the result.
+func (r *BoltRepository) updateChat(chatId string, fn func(chat *Chat) error) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		chat, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		if err := fn(chat); err != nil {
+			return err
+		}
+		return putChat(tx, chat)
+	})
+}
+
+// AddChat adds a new chat to the repository and returns its ID.
+func (r *BoltRepository) AddChat(name, personaID string, settings Settings) (string, error) {
+	chat := &Chat{
+		id:        uuid.New().String(),
+		name:      name,
+		personaID: personaID,
+		settings:  settings,
+		prompts:   make([]Prompt, 0),
+		createdAt: time.Now(),
+		updatedAt: time.Now(),
+	}
+
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return putChat(tx, chat)
+	})
+	if err != nil {
+		return "", err
+	}
+	return chat.id, nil
+}
+
+// GetChat retrieves a copy of a chat by its ID.
+func (r *BoltRepository) GetChat(chatId string) (*Chat, error) {
+	var chat *Chat
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		chat, err = getChat(tx, chatId)
+		return err
+	})
+	return chat, err
+}
+
+// ListChats returns every chat, most recently updated first.
+func (r *BoltRepository) ListChats() ([]Chat, error) {
+	var chats []Chat
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(chatsBucket).ForEach(func(k, v []byte) error {
+			var record chatRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("decoding chat %s: %w", k, err)
+			}
+			chats = append(chats, *fromChatRecord(record))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortChats(chats)
+	return chats, nil
+}
+
+// RenameChat updates the name of an existing chat.
+func (r *BoltRepository) RenameChat(chatId, newName string) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		chat.name = newName
+		chat.updatedAt = time.Now()
+		return nil
+	})
+}
+
+// UpdateSettings replaces the generation settings of a chat.
+func (r *BoltRepository) UpdateSettings(chatId string, settings Settings) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		chat.settings = settings
+		chat.updatedAt = time.Now()
+		return nil
+	})
+}
+
+// DeleteChat removes a chat from the repository.
+func (r *BoltRepository) DeleteChat(chatId string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(chatsBucket)
+		if bucket.Get([]byte(chatId)) == nil {
+			return ErrChatNotFound
+		}
+		return bucket.Delete([]byte(chatId))
+	})
+}
+
+// SetDeletedAt moves a chat to the trash at the given time; the zero time restores it.
+func (r *BoltRepository) SetDeletedAt(chatId string, deletedAt time.Time) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		chat.deletedAt = deletedAt
+		return nil
+	})
+}
+
+// SetArchived archives or unarchives a chat.
+func (r *BoltRepository) SetArchived(chatId string, archived bool) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		chat.archived = archived
+		return nil
+	})
+}
+
+// SubmitPrompt submits a prompt to a chat.
+func (r *BoltRepository) SubmitPrompt(chatId, promptText string) (*Prompt, error) {
+	prompt := Prompt{
+		id:        uuid.New().String(),
+		text:      promptText,
+		status:    PromptPending,
+		responses: make([]Response, 0),
+		createdAt: time.Now(),
+		updatedAt: time.Now(),
+	}
+
+	err := r.updateChat(chatId, func(chat *Chat) error {
+		chat.prompts = append(chat.prompts, prompt)
+		chat.updatedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &prompt, nil
+}
+
+// AddResponse adds an empty response to a specific prompt in a chat and returns its ID.
+func (r *BoltRepository) AddResponse(chatId, promptId string) (string, error) {
+	response := Response{
+		id:        uuid.New().String(),
+		createdAt: time.Now(),
+		updatedAt: time.Now(),
+	}
+
+	err := r.updateChat(chatId, func(chat *Chat) error {
+		for i := range chat.prompts {
+			if chat.prompts[i].id == promptId {
+				chat.prompts[i].responses = append(chat.prompts[i].responses, response)
+				chat.prompts[i].updatedAt = time.Now()
+				chat.updatedAt = time.Now()
+				return nil
+			}
+		}
+		return ErrPromptNotFound
+	})
+	if err != nil {
+		return "", err
+	}
+	return response.id, nil
+}
+
+// UpdateResponse replaces the text of a specific response.
+func (r *BoltRepository) UpdateResponse(chatId, promptId, responseId, responseText string) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		for i := range chat.prompts {
+			if chat.prompts[i].id != promptId {
+				continue
+			}
+			for j := range chat.prompts[i].responses {
+				if chat.prompts[i].responses[j].id == responseId {
+					chat.prompts[i].responses[j].text = responseText
+					chat.prompts[i].responses[j].updatedAt = time.Now()
+					chat.updatedAt = time.Now()
+					return nil
+				}
+			}
+			return ErrResponseNotFound
+		}
+		return ErrPromptNotFound
+	})
+}
+
+// SetPromptStatus updates the status of a specific prompt in a chat.
+func (r *BoltRepository) SetPromptStatus(chatId, promptId string, status PromptStatus) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		for i := range chat.prompts {
+			if chat.prompts[i].id == promptId {
+				chat.prompts[i].status = status
+				chat.prompts[i].updatedAt = time.Now()
+				chat.updatedAt = time.Now()
+				return nil
+			}
+		}
+		return ErrPromptNotFound
+	})
+}
+
+// SetPromptSettings sets the settings overriding the chat's for a prompt; nil clears them.
+func (r *BoltRepository) SetPromptSettings(chatId, promptId string, settings *Settings) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		for i := range chat.prompts {
+			if chat.prompts[i].id == promptId {
+				chat.prompts[i].settings = settings
+				chat.prompts[i].updatedAt = time.Now()
+				chat.updatedAt = time.Now()
+				return nil
+			}
+		}
+		return ErrPromptNotFound
+	})
+}
+
+// SetPreferredResponse chooses the response of a prompt used for the chat
+// history. An empty responseId falls back to the latest response.
+func (r *BoltRepository) SetPreferredResponse(chatId, promptId, responseId string) error {
+	return r.updateChat(chatId, func(chat *Chat) error {
+		for i := range chat.prompts {
+			if chat.prompts[i].id != promptId {
+				continue
+			}
+			if responseId != "" && !chat.prompts[i].hasResponse(responseId) {
+				return ErrResponseNotFound
+			}
+			chat.prompts[i].preferredResponseId = responseId
+			chat.prompts[i].updatedAt = time.Now()
+			chat.updatedAt = time.Now()
+			return nil
+		}
+		return ErrPromptNotFound
+	})
+}
+
+// DB returns the database, for repositories of other packages that keep
+// their data next to the chats.
+func (r *BoltRepository) DB() *bolt.DB {
+	return r.db
+}
+
+// Close closes the database file.
+func (r *BoltRepository) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,237 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// seedDatabase writes a database at the given schema version holding the
+// chats, keyed by ID, in whatever format that version stored them.
+func seedDatabase(t *testing.T, path string, version int, chats map[string]string) {
+	t.Helper()
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(schemaVersionKey, binary.BigEndian.AppendUint64(nil, uint64(version))); err != nil {
+			return err
+		}
+		if len(chats) == 0 {
+			return nil
+		}
+		bucket, err := tx.CreateBucket(chatsBucket)
+		if err != nil {
+			return err
+		}
+		for id, data := range chats {
+			if err := bucket.Put([]byte(id), []byte(data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("seeding database: %v", err)
+	}
+}
+
+// schemaVersion returns the schema version stored in the repository's database.
+func schemaVersion(t *testing.T, repo *BoltRepository) int {
+	t.Helper()
+
+	var version int
+	err := repo.DB().View(func(tx *bolt.Tx) error {
+		version = int(binary.BigEndian.Uint64(tx.Bucket(metaBucket).Get(schemaVersionKey)))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading schema version: %v", err)
+	}
+	return version
+}
+
+// storedChat returns the raw document of a chat.
+func storedChat(t *testing.T, repo *BoltRepository, chatId string) []byte {
+	t.Helper()
+
+	var data []byte
+	err := repo.DB().View(func(tx *bolt.Tx) error {
+		data = bytes.Clone(tx.Bucket(chatsBucket).Get([]byte(chatId)))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading chat: %v", err)
+	}
+	return data
+}
+
+func TestBoltRepositoryMigratesNewDatabase(t *testing.T) {
+	repo, err := NewBoltRepository(filepath.Join(t.TempDir(), "chats.db"))
+	if err != nil {
+		t.Fatalf("NewBoltRepository: %v", err)
+	}
+	defer repo.Close()
+
+	if version := schemaVersion(t, repo); version != len(migrations) {
+		t.Errorf("schema version is %d, want %d", version, len(migrations))
+	}
+	err = repo.DB().View(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{chatsBucket, PersonasBucket} {
+			if tx.Bucket(bucket) == nil {
+				t.Errorf("bucket %s is missing", bucket)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltRepositoryReopenIsNoOp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chats.db")
+	repo, err := NewBoltRepository(path)
+	if err != nil {
+		t.Fatalf("NewBoltRepository: %v", err)
+	}
+	chatId, err := repo.AddChat("Chat", "", Settings{})
+	if err != nil {
+		t.Fatalf("AddChat: %v", err)
+	}
+	prompt, err := repo.SubmitPrompt(chatId, "Hello")
+	if err != nil {
+		t.Fatalf("SubmitPrompt: %v", err)
+	}
+	responseId, err := repo.AddResponse(chatId, prompt.Id())
+	if err != nil {
+		t.Fatalf("AddResponse: %v", err)
+	}
+	if err := repo.UpdateResponse(chatId, prompt.Id(), responseId, "Hi there"); err != nil {
+		t.Fatalf("UpdateResponse: %v", err)
+	}
+	before := storedChat(t, repo, chatId)
+	repo.Close()
+
+	repo, err = NewBoltRepository(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer repo.Close()
+
+	if version := schemaVersion(t, repo); version != len(migrations) {
+		t.Errorf("schema version is %d after reopening, want %d", version, len(migrations))
+	}
+	if after := storedChat(t, repo, chatId); !bytes.Equal(before, after) {
+		t.Errorf("reopening changed the stored chat from %s to %s", before, after)
+	}
+	c, err := repo.GetChat(chatId)
+	if err != nil {
+		t.Fatalf("GetChat: %v", err)
+	}
+	if text := c.Prompts()[0].Responses()[0].Text(); text != "Hi there" {
+		t.Errorf("response text is %q after reopening, want %q", text, "Hi there")
+	}
+}
+
+func TestBoltRepositoryRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chats.db")
+	seedDatabase(t, path, len(migrations)+1, nil)
+
+	repo, err := NewBoltRepository(path)
+	if err == nil {
+		repo.Close()
+		t.Fatal("NewBoltRepository opened a database newer than it supports")
+	}
+}
+
+func TestBoltRepositoryUpgradesVersion1(t *testing.T) {
+	// Version 1 stored one response per streamed token
+	const chatV1 = `{
+		"id": "chat-1",
+		"name": "Old chat",
+		"prompts": [
+			{
+				"id": "prompt-1",
+				"text": "Hello",
+				"status": "completed",
+				"responses": [
+					{"id": "r1", "text": "Hi ", "createdAt": "2024-05-01T10:00:01Z"},
+					{"id": "r2", "text": "there", "createdAt": "2024-05-01T10:00:02Z"},
+					{"id": "r3", "text": "!", "createdAt": "2024-05-01T10:00:03Z"}
+				],
+				"createdAt": "2024-05-01T10:00:00Z",
+				"updatedAt": "2024-05-01T10:00:03Z"
+			},
+			{
+				"id": "prompt-2",
+				"text": "Still there?",
+				"status": "failed",
+				"responses": [],
+				"createdAt": "2024-05-01T10:01:00Z",
+				"updatedAt": "2024-05-01T10:01:00Z"
+			}
+		],
+		"createdAt": "2024-05-01T10:00:00Z",
+		"updatedAt": "2024-05-01T10:01:00Z"
+	}`
+	path := filepath.Join(t.TempDir(), "chats.db")
+	seedDatabase(t, path, 1, map[string]string{"chat-1": chatV1})
+
+	repo, err := NewBoltRepository(path)
+	if err != nil {
+		t.Fatalf("NewBoltRepository: %v", err)
+	}
+	defer repo.Close()
+
+	if version := schemaVersion(t, repo); version != len(migrations) {
+		t.Errorf("schema version is %d, want %d", version, len(migrations))
+	}
+	err = repo.DB().View(func(tx *bolt.Tx) error {
+		if tx.Bucket(PersonasBucket) == nil {
+			t.Error("personas bucket is missing")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := repo.GetChat("chat-1")
+	if err != nil {
+		t.Fatalf("GetChat: %v", err)
+	}
+	if c.Name() != "Old chat" || len(c.Prompts()) != 2 {
+		t.Fatalf("chat %q has %d prompts, want the old chat with 2", c.Name(), len(c.Prompts()))
+	}
+	responses := c.Prompts()[0].Responses()
+	if len(responses) != 1 {
+		t.Fatalf("first prompt has %d responses, want the tokens merged into 1", len(responses))
+	}
+	if responses[0].Id() != "r1" || responses[0].Text() != "Hi there!" {
+		t.Errorf("merged response is %s %q, want r1 %q", responses[0].Id(), responses[0].Text(), "Hi there!")
+	}
+	if want := time.Date(2024, 5, 1, 10, 0, 3, 0, time.UTC); !responses[0].UpdatedAt().Equal(want) {
+		t.Errorf("merged response was updated at %s, want the time of the last token %s", responses[0].UpdatedAt(), want)
+	}
+	if n := len(c.Prompts()[1].Responses()); n != 0 {
+		t.Errorf("second prompt has %d responses, want none", n)
+	}
+
+	// The upgraded chat is stored in the current format and can be added to
+	if err := repo.UpdateResponse("chat-1", "prompt-1", "r1", "Hi there, again!"); err != nil {
+		t.Errorf("UpdateResponse on the upgraded chat: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package chat
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,37 +13,252 @@ import (
 type Chat struct {
 	id        string
 	name      string
+	personaID string
+	settings  Settings
 	prompts   []Prompt
 	createdAt time.Time
 	updatedAt time.Time
+	archived  bool
+	deletedAt time.Time // zero unless the chat is in the trash
 }
 
+func (c Chat) Id() string {
+	return c.id
+}
+
+func (c Chat) Name() string {
+	return c.name
+}
+
+// Prompts returns the prompts of the chat, oldest first.
+func (c Chat) Prompts() []Prompt {
+	return c.prompts
+}
+
+func (c Chat) CreatedAt() time.Time {
+	return c.createdAt
+}
+
+func (c Chat) UpdatedAt() time.Time {
+	return c.updatedAt
+}
+
+// Archived reports whether the chat was archived, hiding it from the chat list.
+func (c Chat) Archived() bool {
+	return c.archived
+}
+
+// Deleted reports whether the chat is in the trash.
+func (c Chat) Deleted() bool {
+	return !c.deletedAt.IsZero()
+}
+
+// DeletedAt returns when the chat was moved to the trash, or the zero time.
+func (c Chat) DeletedAt() time.Time {
+	return c.deletedAt
+}
+
+// PersonaID returns the ID of the persona the chat was created with, if any.
+func (c Chat) PersonaID() string {
+	return c.personaID
+}
+
+func (c Chat) Settings() Settings {
+	return c.settings
+}
+
+// clone returns a copy of the chat that shares no prompts or responses with
+// it, so it can be read while the original is being changed.
+func (c Chat) clone() Chat {
+	prompts := make([]Prompt, len(c.prompts))
+	for i, prompt := range c.prompts {
+		prompts[i] = prompt.clone()
+	}
+	c.prompts = prompts
+	return c
+}
+
+// PromptStatus tracks how far the answer to a prompt has progressed.
+type PromptStatus string
+
+const (
+	PromptPending    PromptStatus = "pending"
+	PromptGenerating PromptStatus = "generating"
+	PromptCompleted  PromptStatus = "completed"
+	PromptFailed     PromptStatus = "failed"
+	PromptCancelled  PromptStatus = "cancelled"
+)
+
 // Prompt represents a prompt in a chat.
 type Prompt struct {
-	id        string
-	text      string
-	responses []Response
-	createdAt time.Time
-	updatedAt time.Time
+	id                  string
+	text                string
+	status              PromptStatus
+	settings            *Settings // overrides the chat settings when regenerating
+	responses           []Response
+	preferredResponseId string
+	createdAt           time.Time
+	updatedAt           time.Time
 }
 
 func (p Prompt) Id() string {
 	return p.id
 }
 
-// Response represents a response to a prompt.
+func (p Prompt) Text() string {
+	return p.text
+}
+
+func (p Prompt) Status() PromptStatus {
+	return p.status
+}
+
+func (p Prompt) CreatedAt() time.Time {
+	return p.createdAt
+}
+
+// Settings returns the settings overriding the chat's for this prompt, or nil.
+func (p Prompt) Settings() *Settings {
+	return p.settings
+}
+
+// clone returns a copy of the prompt that shares no responses with it.
+func (p Prompt) clone() Prompt {
+	p.responses = append([]Response(nil), p.responses...)
+	if p.settings != nil {
+		settings := *p.settings
+		p.settings = &settings
+	}
+	return p
+}
+
+// Busy reports whether the prompt is waiting for or receiving an answer.
+func (p Prompt) Busy() bool {
+	return p.status == PromptPending || p.status == PromptGenerating
+}
+
+// StreamingText returns the text generated so far while the prompt is being
+// answered, and an empty string otherwise.
+func (p Prompt) StreamingText() string {
+	if p.status != PromptGenerating || len(p.responses) == 0 {
+		return ""
+	}
+	return p.responses[len(p.responses)-1].text
+}
+
+// Responses returns the alternative responses to the prompt, oldest first.
+func (p Prompt) Responses() []Response {
+	return p.responses
+}
+
+// PreferredResponseId returns the ID of the response chosen for the chat
+// history, or an empty string if none was chosen.
+func (p Prompt) PreferredResponseId() string {
+	return p.preferredResponseId
+}
+
+// hasResponse reports whether the prompt has a response with the given ID.
+func (p Prompt) hasResponse(responseId string) bool {
+	for _, response := range p.responses {
+		if response.id == responseId {
+			return true
+		}
+	}
+	return false
+}
+
+// PreferredResponseIndex returns the index of the response used as the answer
+// to the prompt: the preferred one if chosen, the latest otherwise. It
+// returns -1 if the prompt has no responses.
+func (p Prompt) PreferredResponseIndex() int {
+	for i, response := range p.responses {
+		if response.id == p.preferredResponseId {
+			return i
+		}
+	}
+	return len(p.responses) - 1
+}
+
+// preferredResponse returns the response used as the answer to the prompt.
+func (p Prompt) preferredResponse() (Response, bool) {
+	i := p.PreferredResponseIndex()
+	if i < 0 {
+		return Response{}, false
+	}
+	return p.responses[i], true
+}
+
+// Response represents a response to a prompt. A prompt may have several
+// alternative responses, each assembled from the tokens of one generation.
 type Response struct {
 	id        string
 	text      string
 	createdAt time.Time
+	updatedAt time.Time
+}
+
+func (r Response) Id() string {
+	return r.id
+}
+
+func (r Response) Text() string {
+	return r.text
+}
+
+func (r Response) CreatedAt() time.Time {
+	return r.createdAt
+}
+
+func (r Response) UpdatedAt() time.Time {
+	return r.updatedAt
 }
 
 var (
-	ErrChatNotFound   = errors.New("chat not found")
-	ErrPromptNotFound = errors.New("prompt not found")
+	ErrChatNotFound     = errors.New("chat not found")
+	ErrPromptNotFound   = errors.New("prompt not found")
+	ErrResponseNotFound = errors.New("response not found")
+	ErrPromptBusy       = errors.New("prompt is still being answered")
+	ErrChatDeleted      = errors.New("chat is in the trash")
+	ErrChatNotDeleted   = errors.New("chat is not in the trash")
+	ErrNameRequired     = errors.New("chat name is required")
 )
 
-// ChatRepository manages the storage and retrieval of chats, prompts, and responses.
+// Repository manages the storage and retrieval of chats, prompts, and responses.
+type Repository interface {
+	// AddChat adds a new chat created with the given persona and settings and returns its ID.
+	AddChat(name, personaID string, settings Settings) (string, error)
+	// GetChat returns a copy of a chat by its ID that later changes do not affect.
+	GetChat(chatId string) (*Chat, error)
+	// ListChats returns every chat, most recently updated first.
+	ListChats() ([]Chat, error)
+	// RenameChat updates the name of an existing chat.
+	RenameChat(chatId, newName string) error
+	// DeleteChat removes a chat for good.
+	DeleteChat(chatId string) error
+	// SetDeletedAt moves a chat to the trash at the given time; the zero time restores it.
+	SetDeletedAt(chatId string, deletedAt time.Time) error
+	// SetArchived archives or unarchives a chat.
+	SetArchived(chatId string, archived bool) error
+	// UpdateSettings replaces the generation settings of a chat.
+	UpdateSettings(chatId string, settings Settings) error
+	// SubmitPrompt adds a prompt to a chat.
+	SubmitPrompt(chatId, promptText string) (*Prompt, error)
+	// AddResponse adds an empty response to a specific prompt in a chat and returns its ID.
+	AddResponse(chatId, promptId string) (string, error)
+	// UpdateResponse replaces the text of a specific response.
+	UpdateResponse(chatId, promptId, responseId, responseText string) error
+	// SetPromptStatus updates the status of a specific prompt in a chat.
+	SetPromptStatus(chatId, promptId string, status PromptStatus) error
+	// SetPromptSettings sets the settings overriding the chat's for a prompt; nil clears them.
+	SetPromptSettings(chatId, promptId string, settings *Settings) error
+	// SetPreferredResponse chooses the response of a prompt used for the chat
+	// history. An empty responseId falls back to the latest response.
+	SetPreferredResponse(chatId, promptId, responseId string) error
+	// Close releases the resources held by the repository.
+	Close() error
+}
+
+// ChatRepository is an in-memory Repository. Its contents are lost on restart.
 type ChatRepository struct {
 	chats map[string]*Chat
 	mu    sync.Mutex
@@ -56,23 +272,25 @@ func NewChatRepository() *ChatRepository {
 }
 
 // AddChat adds a new chat to the repository and returns its ID.
-func (r *ChatRepository) AddChat(name string) string {
+func (r *ChatRepository) AddChat(name, personaID string, settings Settings) (string, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	chat := &Chat{
 		id:        uuid.New().String(),
 		name:      name,
+		personaID: personaID,
+		settings:  settings,
 		prompts:   make([]Prompt, 0),
 		createdAt: time.Now(),
 		updatedAt: time.Now(),
 	}
 
 	r.chats[chat.id] = chat
-	return chat.id
+	return chat.id, nil
 }
 
-// GetChat retrieves a chat by its ID.
+// GetChat returns a copy of a chat by its ID.
 func (r *ChatRepository) GetChat(chatId string) (*Chat, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -82,7 +300,28 @@ func (r *ChatRepository) GetChat(chatId string) (*Chat, error) {
 		return nil, ErrChatNotFound
 	}
 
-	return chat, nil
+	copied := chat.clone()
+	return &copied, nil
+}
+
+// ListChats returns a copy of every chat, most recently updated first.
+func (r *ChatRepository) ListChats() ([]Chat, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chats := make([]Chat, 0, len(r.chats))
+	for _, chat := range r.chats {
+		chats = append(chats, chat.clone())
+	}
+	sortChats(chats)
+	return chats, nil
+}
+
+// sortChats orders chats most recently updated first.
+func sortChats(chats []Chat) {
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].updatedAt.After(chats[j].updatedAt)
+	})
 }
 
 // RenameChat updates the name of an existing chat.
@@ -100,6 +339,21 @@ func (r *ChatRepository) RenameChat(chatId, newName string) error {
 	return nil
 }
 
+// UpdateSettings replaces the generation settings of a chat.
+func (r *ChatRepository) UpdateSettings(chatId string, settings Settings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat, exists := r.chats[chatId]
+	if !exists {
+		return ErrChatNotFound
+	}
+
+	chat.settings = settings
+	chat.updatedAt = time.Now()
+	return nil
+}
+
 // DeleteChat removes a chat from the repository.
 func (r *ChatRepository) DeleteChat(chatId string) error {
 	r.mu.Lock()
@@ -114,6 +368,34 @@ func (r *ChatRepository) DeleteChat(chatId string) error {
 	return nil
 }
 
+// SetDeletedAt moves a chat to the trash at the given time; the zero time restores it.
+func (r *ChatRepository) SetDeletedAt(chatId string, deletedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat, exists := r.chats[chatId]
+	if !exists {
+		return ErrChatNotFound
+	}
+
+	chat.deletedAt = deletedAt
+	return nil
+}
+
+// SetArchived archives or unarchives a chat.
+func (r *ChatRepository) SetArchived(chatId string, archived bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat, exists := r.chats[chatId]
+	if !exists {
+		return ErrChatNotFound
+	}
+
+	chat.archived = archived
+	return nil
+}
+
 // SubmitPrompt submits a prompt to a chat.
 func (r *ChatRepository) SubmitPrompt(chatId, promptText string) (*Prompt, error) {
 	r.mu.Lock()
@@ -127,6 +409,7 @@ func (r *ChatRepository) SubmitPrompt(chatId, promptText string) (*Prompt, error
 	prompt := Prompt{
 		id:        uuid.New().String(),
 		text:      promptText,
+		status:    PromptPending,
 		responses: make([]Response, 0),
 		createdAt: time.Now(),
 		updatedAt: time.Now(),
@@ -138,30 +421,134 @@ func (r *ChatRepository) SubmitPrompt(chatId, promptText string) (*Prompt, error
 	return &prompt, nil
 }
 
-// AddResponseToPrompt adds a response to a specific prompt in a chat.
-func (r *ChatRepository) AddResponseToPrompt(chatId, promptId, responseText string) error {
+// AddResponse adds an empty response to a specific prompt in a chat and returns its ID.
+func (r *ChatRepository) AddResponse(chatId, promptId string) (string, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	chat, exists := r.chats[chatId]
 	if !exists {
-		return ErrChatNotFound
+		return "", ErrChatNotFound
 	}
 
 	for i, prompt := range chat.prompts {
 		if prompt.id == promptId {
 			response := Response{
 				id:        uuid.New().String(),
-				text:      responseText,
 				createdAt: time.Now(),
+				updatedAt: time.Now(),
 			}
 			prompt.responses = append(prompt.responses, response)
 			prompt.updatedAt = time.Now()
 			chat.prompts[i] = prompt
 			chat.updatedAt = time.Now()
+			return response.id, nil
+		}
+	}
+
+	return "", ErrPromptNotFound
+}
+
+// UpdateResponse replaces the text of a specific response.
+func (r *ChatRepository) UpdateResponse(chatId, promptId, responseId, responseText string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat, exists := r.chats[chatId]
+	if !exists {
+		return ErrChatNotFound
+	}
+
+	for i := range chat.prompts {
+		if chat.prompts[i].id != promptId {
+			continue
+		}
+		for j := range chat.prompts[i].responses {
+			if chat.prompts[i].responses[j].id == responseId {
+				chat.prompts[i].responses[j].text = responseText
+				chat.prompts[i].responses[j].updatedAt = time.Now()
+				chat.updatedAt = time.Now()
+				return nil
+			}
+		}
+		return ErrResponseNotFound
+	}
+
+	return ErrPromptNotFound
+}
+
+// SetPromptStatus updates the status of a specific prompt in a chat.
+func (r *ChatRepository) SetPromptStatus(chatId, promptId string, status PromptStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat, exists := r.chats[chatId]
+	if !exists {
+		return ErrChatNotFound
+	}
+
+	for i := range chat.prompts {
+		if chat.prompts[i].id == promptId {
+			chat.prompts[i].status = status
+			chat.prompts[i].updatedAt = time.Now()
+			chat.updatedAt = time.Now()
+			return nil
+		}
+	}
+
+	return ErrPromptNotFound
+}
+
+// SetPromptSettings sets the settings overriding the chat's for a prompt; nil clears them.
+func (r *ChatRepository) SetPromptSettings(chatId, promptId string, settings *Settings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat, exists := r.chats[chatId]
+	if !exists {
+		return ErrChatNotFound
+	}
+
+	for i := range chat.prompts {
+		if chat.prompts[i].id == promptId {
+			chat.prompts[i].settings = settings
+			chat.prompts[i].updatedAt = time.Now()
+			chat.updatedAt = time.Now()
 			return nil
 		}
 	}
 
 	return ErrPromptNotFound
 }
+
+// SetPreferredResponse chooses the response of a prompt used for the chat
+// history. An empty responseId falls back to the latest response.
+func (r *ChatRepository) SetPreferredResponse(chatId, promptId, responseId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chat, exists := r.chats[chatId]
+	if !exists {
+		return ErrChatNotFound
+	}
+
+	for i := range chat.prompts {
+		if chat.prompts[i].id != promptId {
+			continue
+		}
+		if responseId != "" && !chat.prompts[i].hasResponse(responseId) {
+			return ErrResponseNotFound
+		}
+		chat.prompts[i].preferredResponseId = responseId
+		chat.prompts[i].updatedAt = time.Now()
+		chat.updatedAt = time.Now()
+		return nil
+	}
+
+	return ErrPromptNotFound
+}
+
+// Close is a no-op for the in-memory repository.
+func (r *ChatRepository) Close() error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package chat
+
+import "testing"
+
+func TestChatRepositoryReturnsCopies(t *testing.T) {
+	repo := NewChatRepository()
+	chatId, err := repo.AddChat("Chat", "", Settings{})
+	if err != nil {
+		t.Fatalf("AddChat: %v", err)
+	}
+	prompt, err := repo.SubmitPrompt(chatId, "Hello")
+	if err != nil {
+		t.Fatalf("SubmitPrompt: %v", err)
+	}
+	responseId, err := repo.AddResponse(chatId, prompt.Id())
+	if err != nil {
+		t.Fatalf("AddResponse: %v", err)
+	}
+
+	got, err := repo.GetChat(chatId)
+	if err != nil {
+		t.Fatalf("GetChat: %v", err)
+	}
+	listed, err := repo.ListChats()
+	if err != nil {
+		t.Fatalf("ListChats: %v", err)
+	}
+
+	// Changes after the chat was read must not show through the copies
+	if err := repo.UpdateResponse(chatId, prompt.Id(), responseId, "Hi there"); err != nil {
+		t.Fatalf("UpdateResponse: %v", err)
+	}
+	if err := repo.SetPromptStatus(chatId, prompt.Id(), PromptCompleted); err != nil {
+		t.Fatalf("SetPromptStatus: %v", err)
+	}
+	if _, err := repo.SubmitPrompt(chatId, "Again"); err != nil {
+		t.Fatalf("SubmitPrompt: %v", err)
+	}
+
+	for name, c := range map[string]Chat{"GetChat": *got, "ListChats": listed[0]} {
+		if len(c.Prompts()) != 1 {
+			t.Fatalf("%s: chat has %d prompts, want 1", name, len(c.Prompts()))
+		}
+		p := c.Prompts()[0]
+		if p.Status() != PromptPending {
+			t.Errorf("%s: prompt status is %q, want %q", name, p.Status(), PromptPending)
+		}
+		if text := p.Responses()[0].Text(); text != "" {
+			t.Errorf("%s: response text is %q, want it unchanged", name, text)
+		}
+	}
+
+	// Nor may changes to a copy reach the repository
+	got.Prompts()[0].responses[0].text = "Changed"
+	again, err := repo.GetChat(chatId)
+	if err != nil {
+		t.Fatalf("GetChat: %v", err)
+	}
+	if text := again.Prompts()[0].Responses()[0].Text(); text != "Hi there" {
+		t.Errorf("stored response text is %q, want %q", text, "Hi there")
+	}
+}
@@ -1,43 +1,96 @@
 package chat
 
 import (
+	"context"
+	"demo/events"
 	"demo/pubsub"
+	"errors"
 	"log"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// PersonaDefaults looks up the default settings of a persona preset.
+type PersonaDefaults interface {
+	PersonaSettings(personaID string) (Settings, error)
+}
+
 // ChatService orchestrates operations on chats, prompts, and responses.
 type ChatService struct {
-	repo   *ChatRepository
-	pubSub *pubsub.PubSub
-	mu     sync.Mutex
+	repo          Repository
+	pubSub        *pubsub.PubSub
+	personas      PersonaDefaults
+	generations   *pubsub.Subscription
+	responses     map[string]*responseBuffer // streaming responses by prompt ID
+	flushInterval time.Duration
+	mu            sync.Mutex
 }
 
 // NewChatService creates a new ChatService with the given repository and PubSub system.
-func NewChatService(repo *ChatRepository, pubSub *pubsub.PubSub) *ChatService {
+// Chats created with a persona start from the settings returned by personas.
+func NewChatService(repo Repository, pubSub *pubsub.PubSub, personas PersonaDefaults) *ChatService {
 	return &ChatService{
-		repo:   repo,
-		pubSub: pubSub,
+		repo:          repo,
+		pubSub:        pubSub,
+		personas:      personas,
+		responses:     make(map[string]*responseBuffer),
+		flushInterval: DefaultFlushInterval,
 	}
 }
 
-// CreateChat creates a new chat and publishes a "ChatCreated" event.
-func (s *ChatService) CreateChat(name string) string {
+// CreateChat creates a new chat and publishes a "ChatCreated" event. If
+// personaID is not empty the chat is created with that persona, starting from
+// its default settings.
+func (s *ChatService) CreateChat(name, personaID string) (string, error) {
+	var settings Settings
+	if personaID != "" {
+		var err error
+		settings, err = s.personas.PersonaSettings(personaID)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	chatID := s.repo.AddChat(name)
-	s.pubSub.Publish("ChatCreated", map[string]interface{}{
-		"chatId": chatID,
-		"name":   name,
+	chatID, err := s.repo.AddChat(name, personaID, settings)
+	if err != nil {
+		return "", err
+	}
+
+	pubsub.Publish(s.pubSub, events.ChatCreated{
+		ChatID:    chatID,
+		Name:      name,
+		PersonaID: personaID,
 	})
 
-	return chatID
+	return chatID, nil
+}
+
+// UntitledName is the name of a chat created without one.
+const UntitledName = "New chat"
+
+// NameFromPrompt names a chat after the first prompt submitted to it.
+func NameFromPrompt(prompt string) string {
+	const maxLen = 40
+
+	name := []rune(strings.Join(strings.Fields(prompt), " "))
+	if len(name) <= maxLen {
+		return string(name)
+	}
+	return string(name[:maxLen-1]) + "…"
 }
 
 // RenameChat renames an existing chat and publishes an event.
 func (s *ChatService) RenameChat(chatID, newName string) error {
+	newName = strings.TrimSpace(newName)
+	if newName == "" {
+		return ErrNameRequired
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -47,63 +100,532 @@ func (s *ChatService) RenameChat(chatID, newName string) error {
 	}
 
 	// Publish a "ChatRenamed" event.
-	s.pubSub.Publish("ChatRenamed", map[string]interface{}{
-		"chatId":  chatID,
-		"newName": newName,
+	pubsub.Publish(s.pubSub, events.ChatRenamed{
+		ChatID:  chatID,
+		NewName: newName,
 	})
 
 	return nil
 }
 
-// DeleteChat deletes a chat and publishes an event.
+// DeleteChat moves a chat to the trash and publishes an event. It can be
+// restored until it is purged.
 func (s *ChatService) DeleteChat(chatID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	err := s.repo.DeleteChat(chatID)
+	err := s.repo.SetDeletedAt(chatID, time.Now())
 	if err != nil {
 		return err
 	}
 
 	// Publish a "ChatDeleted" event.
-	s.pubSub.Publish("ChatDeleted", map[string]interface{}{
-		"chatId": chatID,
+	pubsub.Publish(s.pubSub, events.ChatDeleted{
+		ChatID: chatID,
+	})
+
+	return nil
+}
+
+// RestoreChat takes a chat back out of the trash and publishes an event.
+func (s *ChatService) RestoreChat(chatID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.repo.SetDeletedAt(chatID, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	pubsub.Publish(s.pubSub, events.ChatRestored{
+		ChatID: chatID,
+	})
+
+	return nil
+}
+
+// ArchiveChat archives or unarchives a chat and publishes an event. Archived
+// chats are left out of the chat list but keep working.
+func (s *ChatService) ArchiveChat(chatID string, archived bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.repo.SetArchived(chatID, archived)
+	if err != nil {
+		return err
+	}
+
+	pubsub.Publish(s.pubSub, events.ChatArchived{
+		ChatID:   chatID,
+		Archived: archived,
+	})
+
+	return nil
+}
+
+// PurgeChat removes a chat in the trash for good and publishes an event.
+func (s *ChatService) PurgeChat(chatID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return err
+	}
+	if !chat.Deleted() {
+		return ErrChatNotDeleted
+	}
+
+	return s.purge(chatID)
+}
+
+// purge removes a chat for good and publishes an event. The caller must hold s.mu.
+func (s *ChatService) purge(chatID string) error {
+	err := s.repo.DeleteChat(chatID)
+	if err != nil {
+		return err
+	}
+
+	pubsub.Publish(s.pubSub, events.ChatPurged{
+		ChatID: chatID,
+	})
+
+	return nil
+}
+
+// PurgeTrash removes the chats that were moved to the trash longer than
+// retention ago and returns how many were removed.
+func (s *ChatService) PurgeTrash(retention time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chats, err := s.repo.ListChats()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	purged := 0
+	var errs []error
+	for _, chat := range chats {
+		if !chat.Deleted() || chat.deletedAt.After(cutoff) {
+			continue
+		}
+		if err := s.purge(chat.id); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+// MonitorTrash purges the chats older than retention from the trash every
+// interval until ctx is done.
+func (s *ChatService) MonitorTrash(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.PurgeTrash(retention)
+		if err != nil {
+			log.Printf("Failed to purge the trash: %v\n", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d chats from the trash\n", purged)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ListChats returns the chats that are neither archived nor in the trash,
+// most recently updated first.
+func (s *ChatService) ListChats() ([]Chat, error) {
+	return s.listChats(func(chat Chat) bool {
+		return !chat.Deleted() && !chat.archived
+	})
+}
+
+// ListArchivedChats returns the archived chats that are not in the trash,
+// most recently updated first.
+func (s *ChatService) ListArchivedChats() ([]Chat, error) {
+	return s.listChats(func(chat Chat) bool {
+		return !chat.Deleted() && chat.archived
+	})
+}
+
+// ListDeletedChats returns the chats in the trash, most recently deleted first.
+func (s *ChatService) ListDeletedChats() ([]Chat, error) {
+	chats, err := s.listChats(Chat.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].deletedAt.After(chats[j].deletedAt)
+	})
+	return chats, nil
+}
+
+// listChats returns the chats matching keep, most recently updated first.
+func (s *ChatService) listChats(keep func(Chat) bool) ([]Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chats, err := s.repo.ListChats()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := chats[:0]
+	for _, chat := range chats {
+		if keep(chat) {
+			kept = append(kept, chat)
+		}
+	}
+	return kept, nil
+}
+
+// GetChat returns a chat with its prompts and responses, including the text
+// of responses that are still streaming.
+func (s *ChatService) GetChat(chatID string) (Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	view := *chat
+	view.prompts = make([]Prompt, 0, len(chat.prompts))
+	for _, prompt := range chat.prompts {
+		view.prompts = append(view.prompts, s.withBufferedText(prompt))
+	}
+	return view, nil
+}
+
+// GetSettings returns the generation settings of a chat.
+func (s *ChatService) GetSettings(chatID string) (Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return Settings{}, err
+	}
+	return chat.settings, nil
+}
+
+// GetPersonaID returns the ID of the persona a chat was created with, or an
+// empty string if it has none.
+func (s *ChatService) GetPersonaID(chatID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return "", err
+	}
+	return chat.personaID, nil
+}
+
+// UpdateSettings validates and stores the generation settings of a chat and publishes an event.
+func (s *ChatService) UpdateSettings(chatID string, settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.repo.UpdateSettings(chatID, settings)
+	if err != nil {
+		return err
+	}
+
+	// Publish a "ChatSettingsUpdated" event.
+	pubsub.Publish(s.pubSub, events.ChatSettingsUpdated{
+		ChatID: chatID,
 	})
 
 	return nil
 }
 
 // SubmitPrompt submits a prompt, stores it in the repository, and publishes a "PromptSubmitted" event.
+// Chats in the trash do not accept prompts.
 func (s *ChatService) SubmitPrompt(chatID, promptText string) (*Prompt, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	if chat.Deleted() {
+		return nil, ErrChatDeleted
+	}
+
 	prompt, err := s.repo.SubmitPrompt(chatID, promptText)
 	if err != nil {
 		return nil, err
 	}
 
-	s.pubSub.Publish("PromptSubmitted", map[string]interface{}{
-		"chatId":     chatID,
-		"promptId":   prompt.id,
-		"promptText": promptText,
+	pubsub.Publish(s.pubSub, events.PromptSubmitted{
+		ChatID:     chatID,
+		PromptID:   prompt.id,
+		PromptText: promptText,
 	})
 
 	return prompt, nil
 }
 
-// HandleTokensGenerated processes TokensGenerated events and updates the prompt with the response.
+// RecordPrompt stores a prompt whose answer is generated by the caller, so
+// unlike SubmitPrompt it publishes no "PromptSubmitted" event. The answer is
+// stored from the generation events published for the returned prompt.
+func (s *ChatService) RecordPrompt(chatID, promptText string) (*Prompt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	if chat.Deleted() {
+		return nil, ErrChatDeleted
+	}
+
+	return s.repo.SubmitPrompt(chatID, promptText)
+}
+
+// RecordExchange stores a prompt that was already answered elsewhere,
+// together with its answer, as a completed exchange of a chat.
+func (s *ChatService) RecordExchange(chatID, promptText, responseText string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prompt, err := s.repo.SubmitPrompt(chatID, promptText)
+	if err != nil {
+		return err
+	}
+	responseID, err := s.repo.AddResponse(chatID, prompt.id)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.UpdateResponse(chatID, prompt.id, responseID, responseText); err != nil {
+		return err
+	}
+	return s.repo.SetPromptStatus(chatID, prompt.id, PromptCompleted)
+}
+
+// GetPrompt returns a prompt of a chat together with its responses.
+func (s *ChatService) GetPrompt(chatID, promptID string) (Prompt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return Prompt{}, err
+	}
+	for _, prompt := range chat.prompts {
+		if prompt.id == promptID {
+			return s.withBufferedText(prompt), nil
+		}
+	}
+	return Prompt{}, ErrPromptNotFound
+}
+
+// GetPromptSettings returns the settings a prompt is answered with: the
+// chat's settings with the prompt's own overrides applied.
+func (s *ChatService) GetPromptSettings(chatID, promptID string) (Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return Settings{}, err
+	}
+	for _, prompt := range chat.prompts {
+		if prompt.id != promptID {
+			continue
+		}
+		if prompt.settings == nil {
+			return chat.settings, nil
+		}
+		return chat.settings.Merge(*prompt.settings), nil
+	}
+	return Settings{}, ErrPromptNotFound
+}
+
+// RegeneratePrompt answers a prompt again and publishes a "PromptSubmitted"
+// event. The new answer is added next to the earlier responses and becomes the
+// one used for the chat history until another is preferred. Fields set in
+// overrides replace the chat's settings for this prompt. A prompt that is
+// still waiting for or receiving an answer cannot be regenerated.
+func (s *ChatService) RegeneratePrompt(chatID, promptID string, overrides Settings) error {
+	if err := overrides.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatID)
+	if err != nil {
+		return err
+	}
+	var prompt *Prompt
+	for i := range chat.prompts {
+		if chat.prompts[i].id == promptID {
+			prompt = &chat.prompts[i]
+			break
+		}
+	}
+	if prompt == nil {
+		return ErrPromptNotFound
+	}
+	if prompt.Busy() {
+		return ErrPromptBusy
+	}
+
+	if err := s.repo.SetPromptSettings(chatID, promptID, &overrides); err != nil {
+		return err
+	}
+	if err := s.repo.SetPreferredResponse(chatID, promptID, ""); err != nil {
+		return err
+	}
+	if err := s.repo.SetPromptStatus(chatID, promptID, PromptPending); err != nil {
+		return err
+	}
+
+	pubsub.Publish(s.pubSub, events.PromptSubmitted{
+		ChatID:     chatID,
+		PromptID:   promptID,
+		PromptText: prompt.text,
+	})
+
+	return nil
+}
+
+// SetPreferredResponse chooses which response to a prompt the chat history
+// uses from now on, and publishes a "ResponsePreferred" event.
+func (s *ChatService) SetPreferredResponse(chatID, promptID, responseID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.repo.SetPreferredResponse(chatID, promptID, responseID)
+	if err != nil {
+		return err
+	}
+
+	pubsub.Publish(s.pubSub, events.ResponsePreferred{
+		ChatID:     chatID,
+		PromptID:   promptID,
+		ResponseID: responseID,
+	})
+
+	return nil
+}
+
+// Exchange is a prompt together with the response it received.
+type Exchange struct {
+	Prompt   string
+	Response string
+}
+
+// GetHistory returns the exchanges of a chat that precede the given prompt,
+// oldest first. Prompts that never received a response are skipped.
+func (s *ChatService) GetHistory(chatId, promptId string) ([]Exchange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chat, err := s.repo.GetChat(chatId)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]Exchange, 0, len(chat.prompts))
+	for _, prompt := range chat.prompts {
+		if prompt.id == promptId {
+			return history, nil
+		}
+
+		responseText := s.responseText(prompt)
+		if responseText == "" {
+			continue
+		}
+
+		history = append(history, Exchange{
+			Prompt:   prompt.text,
+			Response: responseText,
+		})
+	}
+
+	return nil, ErrPromptNotFound
+}
+
+// RequestStop publishes a "StopRequested" event for the generation answering the given prompt.
+func (s *ChatService) RequestStop(promptID string) {
+	pubsub.Publish(s.pubSub, events.StopRequested{
+		PromptID: promptID,
+	})
+}
+
+// HandleGenerationStarted adds a new response to the prompt that the
+// generation's tokens are assembled into.
+func (s *ChatService) HandleGenerationStarted(chatId, promptId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A prompt streams into one response at a time
+	if err := s.finishResponse(promptId); err != nil {
+		return err
+	}
+	if _, err := s.startResponse(chatId, promptId); err != nil {
+		log.Printf("Error adding response to prompt: %v\n", err)
+		return err
+	}
+
+	err := s.repo.SetPromptStatus(chatId, promptId, PromptGenerating)
+	if err != nil {
+		log.Printf("Error setting prompt status: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// HandleTokensGenerated processes TokensGenerated events and appends the token
+// to the prompt's streaming response. The response is written to the
+// repository at most once per flush interval.
 func (s *ChatService) HandleTokensGenerated(chatId, promptId, responseText string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	buf, exists := s.responses[promptId]
+	if !exists {
+		var err error
+		buf, err = s.startResponse(chatId, promptId)
+		if err != nil {
+			log.Printf("Error adding response to prompt: %v\n", err)
+			return err
+		}
+	}
+
 	// Append the token to the prompt's response.
-	err := s.repo.AddResponseToPrompt(chatId, promptId, responseText)
+	buf.text.WriteString(responseText)
+	if time.Since(buf.lastFlush) < s.flushInterval {
+		return nil
+	}
+
+	err := s.flushResponse(buf)
 	if err != nil {
-		log.Printf("Error adding response to prompt: %v\n", err)
+		log.Printf("Error flushing response of PromptID=%s: %v\n", promptId, err)
 		return err
 	}
-	log.Printf("Token added to ChatID=%s, PromptID=%s: %s\n", "***", promptId, responseText)
 	return nil
 }
 
@@ -119,60 +641,205 @@ func (s *ChatService) GetRecentAggregatedTokens(chatId, promptId string) (string
 
 	for _, prompt := range chat.prompts {
 		if prompt.id == promptId {
-			var responseText strings.Builder
-			for _, response := range prompt.responses {
-				responseText.WriteString(response.text)
-			}
-			return responseText.String(), nil
+			return s.responseText(prompt), nil
 		}
 	}
 
 	return "", ErrPromptNotFound
 }
 
-func (s *ChatService) ListenForTokensGenerated() <-chan string {
-	tokenCh := make(chan string, 100)
-	go func() {
-		s.pubSub.Subscribe("TokensGenerated", func(payload interface{}) {
-			data, ok := payload.(map[string]interface{})
-			if !ok {
-				log.Println("Invalid payload for TokensGenerated event")
-				return
-			}
+// HandleGenerationEnded flushes the prompt's response and records how its
+// generation ended.
+func (s *ChatService) HandleGenerationEnded(chatId, promptId string, status PromptStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			// Extract event data.
-			chatID, ok := data["chatId"].(string)
-			if !ok {
-				log.Println("Invalid chatId in TokensGenerated event")
-				return
-			}
+	if err := s.finishResponse(promptId); err != nil {
+		return err
+	}
 
-			promptID, ok := data["promptId"].(string)
-			if !ok {
-				log.Println("Invalid promptId in TokensGenerated event")
-				return
-			}
+	err := s.repo.SetPromptStatus(chatId, promptId, status)
+	if err != nil {
+		log.Printf("Error setting prompt status: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Start subscribes the service to the events it persists. Prompts that a
+// previous run left busy, because it stopped mid-generation, are marked
+// failed first; nothing would ever finish them.
+func (s *ChatService) Start() {
+	if err := s.failInterruptedPrompts(); err != nil {
+		log.Printf("Failed to mark interrupted prompts as failed: %v\n", err)
+	}
 
-			responseText, ok := data["responseText"].(string)
-			if !ok {
-				log.Println("Invalid responseText in TokensGenerated event")
+	s.generations = s.pubSub.SubscribeEvents(events.GenerationEvents, func(payload interface{}) {
+		if event, ok := payload.(pubsub.Event); ok {
+			if chatID, _ := generationIDs(event); chatID == "" {
+				// Generations outside any chat, such as unrecorded gateway calls, are not stored
 				return
 			}
+		}
+
+		var err error
+		switch event := payload.(type) {
+		case events.GenerationQueued, events.GenerationRetrying, events.GenerationFallback:
+			// Nothing to store until tokens arrive or generation ends
+		case events.GenerationStarted:
+			err = s.HandleGenerationStarted(event.ChatID, event.PromptID)
+		case events.TokensGenerated:
+			err = s.HandleTokensGenerated(event.ChatID, event.PromptID, event.ResponseText)
+		case events.GenerationCompleted:
+			err = s.HandleGenerationEnded(event.ChatID, event.PromptID, PromptCompleted)
+		case events.GenerationFailed:
+			err = s.HandleGenerationEnded(event.ChatID, event.PromptID, PromptFailed)
+		case events.GenerationCancelled:
+			err = s.HandleGenerationEnded(event.ChatID, event.PromptID, PromptCancelled)
+		default:
+			log.Printf("Unexpected generation event payload: %T\n", payload)
+		}
+		if err != nil {
+			log.Printf("Failed to handle generation event: %v\n", err)
+		}
+	}, pubsub.Ordered())
+}
 
-			go func() {
-				// Send the response text to the token channel.
-				tokenCh <- responseText
-			}()
+// failInterruptedPrompts marks every busy prompt in the repository failed.
+func (s *ChatService) failInterruptedPrompts() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			// Handle the TokensGenerated event and send token to the channel.
-			err := s.HandleTokensGenerated(chatID, promptID, responseText)
-			if err != nil {
-				log.Printf("Failed to handle TokensGenerated event: %v\n", err)
-				return
+	chats, err := s.repo.ListChats()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, chat := range chats {
+		for _, prompt := range chat.prompts {
+			if !prompt.Busy() {
+				continue
+			}
+			log.Printf("Marking interrupted PromptID=%s of ChatID=%s as failed\n", prompt.id, chat.id)
+			if err := s.repo.SetPromptStatus(chat.id, prompt.id, PromptFailed); err != nil {
+				errs = append(errs, err)
 			}
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		})
-	}()
+// WaitForEvents waits until the generation events published so far have
+// been handled, so that reads reflect them.
+func (s *ChatService) WaitForEvents(ctx context.Context) error {
+	if s.generations == nil {
+		return nil
+	}
+	return s.generations.Flush(ctx)
+}
+
+// Flush waits until the generation events published so far have been
+// handled, then writes every buffered response to the repository. If ctx is
+// done first, the text buffered so far is written anyway and ctx's error
+// returned.
+func (s *ChatService) Flush(ctx context.Context) error {
+	waitErr := s.WaitForEvents(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return tokenCh
+	errs := []error{waitErr}
+	for promptId, buf := range s.responses {
+		// Events still queued may add to a response, so it is only
+		// released once they were handled
+		var err error
+		if waitErr != nil {
+			err = s.flushResponse(buf)
+		} else {
+			err = s.finishResponse(promptId)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StreamEvents returns a channel receiving, in order, every generation event
+// (see events.GenerationEvents) for the given chat or prompt. An empty ID
+// matches any value. The subscription is released once ctx is done, or when
+// the reader falls too far behind; the returned done channel is closed in
+// both cases.
+func (s *ChatService) StreamEvents(ctx context.Context, chatID, promptID string) (<-chan pubsub.Event, <-chan struct{}) {
+	eventCh := make(chan pubsub.Event, 100)
+
+	sub := s.pubSub.SubscribeEventsContext(ctx, events.GenerationEvents, func(payload interface{}) {
+		event, ok := payload.(pubsub.Event)
+		if !ok {
+			log.Printf("Unexpected generation event payload: %T\n", payload)
+			return
+		}
+
+		eventChatID, eventPromptID := generationIDs(event)
+		if chatID != "" && chatID != eventChatID {
+			return
+		}
+		if promptID != "" && promptID != eventPromptID {
+			return
+		}
+
+		select {
+		case eventCh <- event:
+		case <-ctx.Done():
+		}
+	}, pubsub.WithOverflowPolicy(pubsub.Disconnect))
+
+	return eventCh, sub.Done()
+}
+
+// StreamChatEvents returns a channel receiving every event that changes the
+// chat list (see events.ChatEvents). The subscription is released once ctx
+// is done, or when the reader falls too far behind; the returned done channel
+// is closed in both cases.
+func (s *ChatService) StreamChatEvents(ctx context.Context) (<-chan pubsub.Event, <-chan struct{}) {
+	eventCh := make(chan pubsub.Event, 100)
+
+	sub := s.pubSub.SubscribeEventsContext(ctx, events.ChatEvents, func(payload interface{}) {
+		event, ok := payload.(pubsub.Event)
+		if !ok {
+			log.Printf("Unexpected chat event payload: %T\n", payload)
+			return
+		}
+
+		select {
+		case eventCh <- event:
+		case <-ctx.Done():
+		}
+	}, pubsub.WithOverflowPolicy(pubsub.Disconnect))
+
+	return eventCh, sub.Done()
+}
+
+// generationIDs returns the chat and prompt a generation event belongs to.
+func generationIDs(event pubsub.Event) (chatID, promptID string) {
+	switch event := event.(type) {
+	case events.GenerationQueued:
+		return event.ChatID, event.PromptID
+	case events.GenerationStarted:
+		return event.ChatID, event.PromptID
+	case events.GenerationRetrying:
+		return event.ChatID, event.PromptID
+	case events.GenerationFallback:
+		return event.ChatID, event.PromptID
+	case events.TokensGenerated:
+		return event.ChatID, event.PromptID
+	case events.GenerationCompleted:
+		return event.ChatID, event.PromptID
+	case events.GenerationFailed:
+		return event.ChatID, event.PromptID
+	case events.GenerationCancelled:
+		return event.ChatID, event.PromptID
+	}
+	return "", ""
 }
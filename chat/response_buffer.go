@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// DefaultFlushInterval is how often a streaming response is written to the
+// repository while tokens keep arriving.
+const DefaultFlushInterval = 2 * time.Second
+
+// responseBuffer accumulates the streamed text of a response until it is
+// flushed to the repository.
+type responseBuffer struct {
+	chatID     string
+	promptID   string
+	responseID string
+	text       strings.Builder
+	flushedLen int
+	lastFlush  time.Time
+}
+
+// startResponse adds a new response to a prompt and buffers its text.
+// The caller must hold s.mu.
+func (s *ChatService) startResponse(chatId, promptId string) (*responseBuffer, error) {
+	responseID, err := s.repo.AddResponse(chatId, promptId)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &responseBuffer{
+		chatID:     chatId,
+		promptID:   promptId,
+		responseID: responseID,
+		lastFlush:  time.Now(),
+	}
+	s.responses[promptId] = buf
+	return buf, nil
+}
+
+// flushResponse writes the buffered text to the repository if it changed.
+// The caller must hold s.mu.
+func (s *ChatService) flushResponse(buf *responseBuffer) error {
+	buf.lastFlush = time.Now()
+	if buf.text.Len() == buf.flushedLen {
+		return nil
+	}
+
+	err := s.repo.UpdateResponse(buf.chatID, buf.promptID, buf.responseID, buf.text.String())
+	if err != nil {
+		return err
+	}
+	buf.flushedLen = buf.text.Len()
+	return nil
+}
+
+// finishResponse flushes and releases the buffer of a prompt, if any.
+// The caller must hold s.mu.
+func (s *ChatService) finishResponse(promptId string) error {
+	buf, exists := s.responses[promptId]
+	if !exists {
+		return nil
+	}
+	delete(s.responses, promptId)
+
+	if err := s.flushResponse(buf); err != nil {
+		log.Printf("Error flushing response of PromptID=%s: %v\n", promptId, err)
+		return err
+	}
+	return nil
+}
+
+// responseText returns the text of the response streaming into a prompt,
+// including text that is still buffered, or else of its preferred response.
+// The caller must hold s.mu.
+func (s *ChatService) responseText(prompt Prompt) string {
+	if buf, exists := s.responses[prompt.id]; exists {
+		return buf.text.String()
+	}
+	response, ok := prompt.preferredResponse()
+	if !ok {
+		return ""
+	}
+	return response.text
+}
+
+// withBufferedText returns a copy of a prompt whose streaming response
+// includes the text that is still buffered. The caller must hold s.mu.
+func (s *ChatService) withBufferedText(prompt Prompt) Prompt {
+	buf, exists := s.responses[prompt.id]
+	if !exists {
+		return prompt
+	}
+
+	prompt.responses = append([]Response(nil), prompt.responses...)
+	for i := range prompt.responses {
+		if prompt.responses[i].id == buf.responseID {
+			prompt.responses[i].text = buf.text.String()
+		}
+	}
+	return prompt
+}
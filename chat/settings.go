@@ -0,0 +1,70 @@
+package chat
+
+import "fmt"
+
+// Settings are the generation parameters of a chat. Nil or empty fields
+// leave the choice to the engine.
+type Settings struct {
+	Model         string   `json:"model,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"topP,omitempty"`
+	TopK          *int     `json:"topK,omitempty"`
+	MaxTokens     *int     `json:"maxTokens,omitempty"`
+	Stop          []string `json:"stop,omitempty"`
+	Seed          *int     `json:"seed,omitempty"`
+	RepeatPenalty *float64 `json:"repeatPenalty,omitempty"`
+}
+
+// Validate reports the first setting that is out of range.
+func (s Settings) Validate() error {
+	if s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2, got %v", *s.Temperature)
+	}
+	if s.TopP != nil && (*s.TopP <= 0 || *s.TopP > 1) {
+		return fmt.Errorf("top_p must be greater than 0 and at most 1, got %v", *s.TopP)
+	}
+	if s.TopK != nil && *s.TopK < 1 {
+		return fmt.Errorf("top_k must be at least 1, got %d", *s.TopK)
+	}
+	if s.MaxTokens != nil && *s.MaxTokens < 1 {
+		return fmt.Errorf("max tokens must be at least 1, got %d", *s.MaxTokens)
+	}
+	if s.RepeatPenalty != nil && *s.RepeatPenalty <= 0 {
+		return fmt.Errorf("repeat penalty must be greater than 0, got %v", *s.RepeatPenalty)
+	}
+	for _, stop := range s.Stop {
+		if stop == "" {
+			return fmt.Errorf("stop sequences must not be empty")
+		}
+	}
+	return nil
+}
+
+// Merge returns the settings with every field set in overrides replaced.
+func (s Settings) Merge(overrides Settings) Settings {
+	if overrides.Model != "" {
+		s.Model = overrides.Model
+	}
+	if overrides.Temperature != nil {
+		s.Temperature = overrides.Temperature
+	}
+	if overrides.TopP != nil {
+		s.TopP = overrides.TopP
+	}
+	if overrides.TopK != nil {
+		s.TopK = overrides.TopK
+	}
+	if overrides.MaxTokens != nil {
+		s.MaxTokens = overrides.MaxTokens
+	}
+	if overrides.Stop != nil {
+		s.Stop = overrides.Stop
+	}
+	if overrides.Seed != nil {
+		s.Seed = overrides.Seed
+	}
+	if overrides.RepeatPenalty != nil {
+		s.RepeatPenalty = overrides.RepeatPenalty
+	}
+	return s
+}
@@ -0,0 +1,27 @@
+package components
+
+import (
+	"strconv"
+	"strings"
+)
+
+// formatFloat renders an optional number for a form input.
+func formatFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// formatInt renders an optional integer for a form input.
+func formatInt(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
+
+// formatLines renders a list one entry per line for a textarea.
+func formatLines(values []string) string {
+	return strings.Join(values, "\n")
+}
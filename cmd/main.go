@@ -1,50 +1,379 @@
 package main
 
 import (
+	"context"
+	"demo/api"
 	"demo/chat"
 	"demo/cmd/components"
+	"demo/config"
+	"demo/events"
+	"demo/gateway"
+	"demo/lifecycle"
+	"demo/persona"
 	"demo/promptprocessing"
 	"demo/pubsub"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 )
 
 func main() {
+	cfg, err := config.Load(os.Args, os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	server, lc, err := newServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+
+	go func() {
+		fmt.Printf("Server is running on %s\n", cfg.Server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server stopped: %v", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Println("Shutting down")
+	if err := lc.Shutdown(); err != nil {
+		log.Fatalf("Shutdown incomplete: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
+
+// newServer creates the services of the application and the server routing
+// requests to them. The returned manager runs their shutdown steps in order.
+// Nothing listens until the server is started.
+func newServer(cfg config.Config) (*http.Server, *lifecycle.Manager, error) {
 	ps := pubsub.NewPubSub()
 
-	chatRepository := chat.NewChatRepository()
-	chatService := chat.NewChatService(chatRepository, ps)
-	tokensCh := chatService.ListenForTokensGenerated()
+	chatRepository, personaRepository, err := newRepositories(cfg.Storage.Backend, cfg.Storage.DBPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening chat storage: %w", err)
+	}
+
+	lc := lifecycle.NewManager(time.Duration(cfg.Server.ShutdownTimeout))
+
+	personaService := persona.NewPersonaService(personaRepository, ps)
+
+	chatService := chat.NewChatService(chatRepository, ps, personaService)
+	chatService.Start()
+
+	// Create the configured LLM engine, then its fallbacks.
+	engines := promptprocessing.NewEngineRegistry()
+	promptprocessingService := promptprocessing.NewPromptProcessingService(ps, engines, chatService, personaService)
+	for _, engineConfig := range append([]config.EngineConfig{cfg.Engine}, cfg.Fallbacks...) {
+		if _, err := engines.Create(engineConfig.EngineConfig()); err != nil {
+			chatRepository.Close()
+			return nil, nil, fmt.Errorf("creating LLM engine: %w", err)
+		}
+		promptprocessingService.SetMaxConcurrent(engineConfig.EngineConfig().Name(), engineConfig.MaxConcurrent)
+	}
+	promptprocessingService.SetPolicy(cfg.Policy())
+	promptprocessingService.SetContextLimits(cfg.Generation.ContextLimits)
+
+	// Verify the engines can serve their models before accepting prompts.
+	for i, engineConfig := range append([]config.EngineConfig{cfg.Engine}, cfg.Fallbacks...) {
+		if engineConfig.SkipProbe {
+			continue
+		}
+		name := engineConfig.EngineConfig().Name()
+		err := probeEngine(engines, name, engineConfig.Pull)
+		if err != nil && i == 0 {
+			chatRepository.Close()
+			return nil, nil, fmt.Errorf("engine %s is not ready: %w (use -skip-probe to start anyway)", name, err)
+		}
+		if err != nil {
+			log.Printf("Fallback engine %s is not ready: %v", name, err)
+		}
+	}
 
-	// Create an Ollama LLM engine.
-	ollamaEngine := promptprocessing.NewOllamaEngine("llama3.1:8b")
-	promptprocessingService := promptprocessing.NewPromptProcessingService(ps, ollamaEngine)
+	if interval := time.Duration(cfg.Generation.HealthCheckInterval); interval > 0 {
+		healthCtx, stopHealthChecks := context.WithCancel(context.Background())
+		go engines.MonitorHealth(healthCtx, interval)
+		lc.OnShutdown("health checks", func(ctx context.Context) error {
+			stopHealthChecks()
+			return nil
+		})
+	}
 	promptprocessingService.Start()
 
+	if cfg.Titles.Enabled {
+		titler := promptprocessing.NewTitler(ps, engines, promptprocessingService.Scheduler(), chatService, cfg.Titles.Engine, cfg.Titles.Model)
+		titler.Start()
+		lc.OnShutdown("titles", titler.Shutdown)
+	}
+
+	if retention := time.Duration(cfg.Storage.TrashRetention); retention > 0 {
+		trashCtx, stopTrashPurge := context.WithCancel(context.Background())
+		go chatService.MonitorTrash(trashCtx, retention, time.Hour)
+		lc.OnShutdown("trash purge", func(ctx context.Context) error {
+			stopTrashPurge()
+			return nil
+		})
+	}
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "index.html")
+		http.ServeFile(w, r, cfg.Server.IndexPath)
+	})
+
+	r.Get("/chats", func(w http.ResponseWriter, r *http.Request) {
+		chats, err := chatService.ListChats()
+		if err != nil {
+			http.Error(w, "Failed to list chats", http.StatusInternalServerError)
+			return
+		}
+
+		components.ChatList(chats, r.URL.Query().Get("active")).Render(r.Context(), w)
+	})
+
+	// Without a chatId this shows a new chat that its first prompt creates
+	r.Get("/chat-component", func(w http.ResponseWriter, r *http.Request) {
+		var c chat.Chat
+		if chatId := r.URL.Query().Get("chatId"); chatId != "" {
+			var err error
+			c, err = chatService.GetChat(chatId)
+			if errors.Is(err, chat.ErrChatNotFound) {
+				http.Error(w, "Chat not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		components.ChatView(c).Render(r.Context(), w)
+	})
+
+	r.Post("/chats", func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if name == "" {
+			name = chat.UntitledName
+		}
+		chatId, err := chatService.CreateChat(name, r.FormValue("personaId"))
+		if errors.Is(err, persona.ErrPersonaNotFound) {
+			http.Error(w, "Persona not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create chat", http.StatusInternalServerError)
+			return
+		}
+		c, err := chatService.GetChat(chatId)
+		if err != nil {
+			http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("HX-Trigger", "ChatsChanged")
+		w.Header().Set("HX-Push-Url", components.ChatURL(chatId))
+		w.WriteHeader(http.StatusCreated)
+		components.ChatView(c).Render(r.Context(), w)
 	})
 
-	// called after POST /prompt
-	r.Get("/stream-component", func(w http.ResponseWriter, r *http.Request) {
+	// renderChatHeader shows the header of a chat with the outcome of an action on it.
+	renderChatHeader := func(w http.ResponseWriter, r *http.Request, chatId, message string) {
+		c, err := chatService.GetChat(chatId)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+			return
+		}
+
+		components.ChatHeader(c, message).Render(r.Context(), w)
+	}
 
-		components.StreamListner().Render(r.Context(), w)
+	r.Patch("/chats/{chatId}", func(w http.ResponseWriter, r *http.Request) {
+		chatId := chi.URLParam(r, "chatId")
+		err := chatService.RenameChat(chatId, r.FormValue("name"))
+		if errors.Is(err, chat.ErrChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+
+		message := "Renamed"
+		if err != nil {
+			message = err.Error()
+		}
+		renderChatHeader(w, r, chatId, message)
 	})
 
-	r.Get("/prompt-component", func(w http.ResponseWriter, r *http.Request) {
-		components.Prompt().Render(r.Context(), w)
+	r.Delete("/chats/{chatId}", func(w http.ResponseWriter, r *http.Request) {
+		chatId := chi.URLParam(r, "chatId")
+		err := chatService.DeleteChat(chatId)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to delete chat", http.StatusInternalServerError)
+			return
+		}
+		c, err := chatService.GetChat(chatId)
+		if err != nil {
+			http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+			return
+		}
+
+		components.ChatDeletedNotice(c).Render(r.Context(), w)
+	})
+
+	r.Post("/chats/{chatId}/restore", func(w http.ResponseWriter, r *http.Request) {
+		chatId := chi.URLParam(r, "chatId")
+		err := chatService.RestoreChat(chatId)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to restore chat", http.StatusInternalServerError)
+			return
+		}
+		c, err := chatService.GetChat(chatId)
+		if err != nil {
+			http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+			return
+		}
+
+		components.ChatView(c).Render(r.Context(), w)
+	})
+
+	archiveHandler := func(archived bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			chatId := chi.URLParam(r, "chatId")
+			err := chatService.ArchiveChat(chatId, archived)
+			if errors.Is(err, chat.ErrChatNotFound) {
+				http.Error(w, "Chat not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to archive chat", http.StatusInternalServerError)
+				return
+			}
+
+			renderChatHeader(w, r, chatId, "")
+		}
+	}
+	r.Post("/chats/{chatId}/archive", archiveHandler(true))
+	r.Post("/chats/{chatId}/unarchive", archiveHandler(false))
+
+	r.Get("/archive-component", func(w http.ResponseWriter, r *http.Request) {
+		chats, err := chatService.ListArchivedChats()
+		if err != nil {
+			http.Error(w, "Failed to list chats", http.StatusInternalServerError)
+			return
+		}
+
+		components.ArchiveView(chats).Render(r.Context(), w)
+	})
+
+	renderTrash := func(w http.ResponseWriter, r *http.Request) {
+		chats, err := chatService.ListDeletedChats()
+		if err != nil {
+			http.Error(w, "Failed to list chats", http.StatusInternalServerError)
+			return
+		}
+
+		components.TrashView(chats, time.Duration(cfg.Storage.TrashRetention)).Render(r.Context(), w)
+	}
+
+	r.Get("/trash-component", renderTrash)
+
+	r.Delete("/trash/{chatId}", func(w http.ResponseWriter, r *http.Request) {
+		err := chatService.PurgeChat(chi.URLParam(r, "chatId"))
+		if errors.Is(err, chat.ErrChatNotFound) || errors.Is(err, chat.ErrChatNotDeleted) {
+			http.Error(w, "Chat not found in the trash", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to purge chat", http.StatusInternalServerError)
+			return
+		}
+
+		renderTrash(w, r)
+	})
+
+	// The sidebar reloads the chat list whenever a chat is added, renamed,
+	// archived or deleted, including from other tabs, and open chats show
+	// their new name.
+	r.Get("/chats/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := r.Context()
+		eventCh, done := chatService.StreamChatEvents(ctx)
+
+		writeSSE(w, flusher, "connected", "Connection established")
+
+		for {
+			select {
+			case event := <-eventCh:
+				writeSSE(w, flusher, "chats", event.EventName())
+				if renamed, ok := event.(events.ChatRenamed); ok {
+					var name strings.Builder
+					components.ChatNameInput(renamed.ChatID, renamed.NewName).Render(ctx, &name)
+					writeSSE(w, flusher, "renamed-"+renamed.ChatID, name.String())
+				}
+			case <-done:
+				if ctx.Err() == nil {
+					// Missed events are made up for by reloading the list once
+					writeSSE(w, flusher, "chats", "Stream lagged behind")
+				}
+				return
+			case <-lc.ShuttingDown():
+				// Tell the client not to reconnect to a server going away
+				writeSSE(w, flusher, "shutdown", "Server is shutting down")
+				writeSSE(w, flusher, "close", "Stream completed")
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
 	})
 
 	// Endpoint to handle prompt submission with UUID generation
 	r.Post("/prompt", func(w http.ResponseWriter, r *http.Request) {
+		if lc.IsShuttingDown() {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
 		// Extract the prompt submitted
 		txt := r.FormValue("prompt")
 		if txt == "" {
@@ -52,35 +381,260 @@ func main() {
 			return
 		}
 
-		chatId := chatService.CreateChat("TestChat")
+		// Follow-up prompts name the chat they continue
+		chatId := r.FormValue("chatId")
+		newChat := chatId == ""
+		if newChat {
+			var err error
+			chatId, err = chatService.CreateChat(chat.NameFromPrompt(txt), r.FormValue("personaId"))
+			if errors.Is(err, persona.ErrPersonaNotFound) {
+				http.Error(w, "Persona not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to create chat", http.StatusInternalServerError)
+				return
+			}
+		}
 		p, err := chatService.SubmitPrompt(chatId, txt)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, chat.ErrChatDeleted) {
+			http.Error(w, "Chat is in the trash", http.StatusConflict)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Failed to submit prompt", http.StatusInternalServerError)
 			return
 		}
 
 		// Trigger an event to notify the client
-		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"PromptSubmitted": {"id": "%s"}}`, p.Id()))
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"PromptSubmitted": {"id": "%s", "chatId": "%s"}, "ChatsChanged": true}`, p.Id(), chatId))
+
+		// A new chat replaces the page's chat view, a follow-up is appended to it
+		if newChat {
+			c, err := chatService.GetChat(chatId)
+			if err != nil {
+				http.Error(w, "Failed to load chat", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("HX-Retarget", "#chat-view")
+			w.Header().Set("HX-Reswap", "outerHTML")
+			w.Header().Set("HX-Push-Url", components.ChatURL(chatId))
+			components.ChatView(c).Render(r.Context(), w)
+			return
+		}
+		components.Exchange(chatId, *p).Render(r.Context(), w)
 	})
 	r.Post("/stop", func(w http.ResponseWriter, r *http.Request) {
-		prompt := r.FormValue("prompt")
-		if prompt == "" {
-			http.Error(w, "prompt is required", http.StatusBadRequest)
+		promptId := r.FormValue("promptId")
+		if promptId == "" {
+			http.Error(w, "promptId is required", http.StatusBadRequest)
+			return
+		}
+
+		chatService.RequestStop(promptId)
+
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Stop requested"))
+	})
+
+	renderSettings := func(w http.ResponseWriter, r *http.Request, chatId string) {
+		settings, err := chatService.GetSettings(chatId)
+		if errors.Is(err, chat.ErrChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load settings", http.StatusInternalServerError)
+			return
+		}
+
+		components.Settings(chatId, settings, "").Render(r.Context(), w)
+	}
+
+	r.Get("/chats/{chatId}/settings", func(w http.ResponseWriter, r *http.Request) {
+		renderSettings(w, r, chi.URLParam(r, "chatId"))
+	})
+
+	r.Post("/chats/{chatId}/settings", func(w http.ResponseWriter, r *http.Request) {
+		chatId := chi.URLParam(r, "chatId")
+		settings, err := parseSettingsForm(r)
+		if err == nil {
+			err = chatService.UpdateSettings(chatId, settings)
+		}
+		if errors.Is(err, chat.ErrChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+
+		// Re-render the form with the submitted values and the outcome
+		message := "Settings saved"
+		if err != nil {
+			message = err.Error()
+		}
+		components.Settings(chatId, settings, message).Render(r.Context(), w)
+	})
+
+	// renderResponses shows the response of a prompt at index, or its
+	// preferred response if index is out of range.
+	renderResponses := func(w http.ResponseWriter, r *http.Request, chatId, promptId string, index int, message string) {
+		prompt, err := chatService.GetPrompt(chatId, promptId)
+		if errors.Is(err, chat.ErrChatNotFound) || errors.Is(err, chat.ErrPromptNotFound) {
+			http.Error(w, "Prompt not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load responses", http.StatusInternalServerError)
+			return
+		}
+
+		if index < 0 || index >= len(prompt.Responses()) {
+			index = prompt.PreferredResponseIndex()
+		}
+		components.Responses(chatId, prompt, index, message).Render(r.Context(), w)
+	}
+
+	r.Get("/chats/{chatId}/prompts/{promptId}/responses", func(w http.ResponseWriter, r *http.Request) {
+		index, err := strconv.Atoi(r.URL.Query().Get("index"))
+		if err != nil {
+			index = -1
+		}
+		renderResponses(w, r, chi.URLParam(r, "chatId"), chi.URLParam(r, "promptId"), index, "")
+	})
+
+	r.Post("/chats/{chatId}/prompts/{promptId}/regenerate", func(w http.ResponseWriter, r *http.Request) {
+		if lc.IsShuttingDown() {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		chatId := chi.URLParam(r, "chatId")
+		promptId := chi.URLParam(r, "promptId")
+		overrides, err := parseSettingsForm(r)
+		if err == nil {
+			err = chatService.RegeneratePrompt(chatId, promptId, overrides)
+		}
+		if errors.Is(err, chat.ErrChatNotFound) || errors.Is(err, chat.ErrPromptNotFound) {
+			http.Error(w, "Prompt not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			renderResponses(w, r, chatId, promptId, -1, err.Error())
+			return
+		}
+
+		// The new answer streams in place of the earlier ones
+		w.Header().Set("HX-Trigger", fmt.Sprintf(`{"PromptSubmitted": {"id": "%s", "chatId": "%s"}}`, promptId, chatId))
+		components.StreamListner(chatId, promptId, "").Render(r.Context(), w)
+	})
+
+	r.Post("/chats/{chatId}/prompts/{promptId}/preferred", func(w http.ResponseWriter, r *http.Request) {
+		chatId := chi.URLParam(r, "chatId")
+		promptId := chi.URLParam(r, "promptId")
+		err := chatService.SetPreferredResponse(chatId, promptId, r.FormValue("responseId"))
+		if errors.Is(err, chat.ErrChatNotFound) || errors.Is(err, chat.ErrPromptNotFound) || errors.Is(err, chat.ErrResponseNotFound) {
+			http.Error(w, "Response not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to prefer response", http.StatusInternalServerError)
+			return
+		}
+
+		renderResponses(w, r, chatId, promptId, -1, "")
+	})
+
+	renderPersonas := func(w http.ResponseWriter, r *http.Request, message string) {
+		personas, err := personaService.ListPersonas()
+		if err != nil {
+			http.Error(w, "Failed to list personas", http.StatusInternalServerError)
+			return
+		}
+		components.Personas(personas, message).Render(r.Context(), w)
+	}
+
+	r.Get("/personas", func(w http.ResponseWriter, r *http.Request) {
+		renderPersonas(w, r, "")
+	})
+
+	r.Get("/persona-select", func(w http.ResponseWriter, r *http.Request) {
+		personas, err := personaService.ListPersonas()
+		if err != nil {
+			http.Error(w, "Failed to list personas", http.StatusInternalServerError)
+			return
+		}
+		components.PersonaSelect(personas).Render(r.Context(), w)
+	})
+
+	r.Post("/personas", func(w http.ResponseWriter, r *http.Request) {
+		settings, err := parseSettingsForm(r)
+		if err == nil {
+			_, err = personaService.CreatePersona(r.FormValue("name"), r.FormValue("system_prompt"), settings)
+		}
+		if err != nil {
+			renderPersonas(w, r, err.Error())
+			return
+		}
+
+		w.Header().Set("HX-Trigger", "PersonasChanged")
+		renderPersonas(w, r, "Persona added")
+	})
+
+	r.Post("/personas/{personaId}", func(w http.ResponseWriter, r *http.Request) {
+		settings, err := parseSettingsForm(r)
+		if err == nil {
+			err = personaService.UpdatePersona(chi.URLParam(r, "personaId"), r.FormValue("name"), r.FormValue("system_prompt"), settings)
+		}
+		if errors.Is(err, persona.ErrPersonaNotFound) {
+			http.Error(w, "Persona not found", http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			renderPersonas(w, r, err.Error())
+			return
+		}
+
+		w.Header().Set("HX-Trigger", "PersonasChanged")
+		renderPersonas(w, r, "Persona saved")
+	})
 
-		err := ollamaEngine.StopGeneration(r.Context(), prompt)
+	r.Delete("/personas/{personaId}", func(w http.ResponseWriter, r *http.Request) {
+		err := personaService.DeletePersona(chi.URLParam(r, "personaId"))
+		if errors.Is(err, persona.ErrPersonaNotFound) {
+			http.Error(w, "Persona not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to stop: %v", err), http.StatusInternalServerError)
+			http.Error(w, "Failed to delete persona", http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Generation stopped successfully"))
+		w.Header().Set("HX-Trigger", "PersonasChanged")
+		renderPersonas(w, r, "Persona deleted")
 	})
 
 	r.Get("/stream", func(w http.ResponseWriter, r *http.Request) {
+		chatId := r.URL.Query().Get("chatId")
+		promptId := r.URL.Query().Get("promptId")
+		if chatId == "" {
+			// Catching up on a prompt needs its chat, so a prompt alone is not enough
+			http.Error(w, "chatId is required", http.StatusBadRequest)
+			return
+		}
+		// The client already shows the answer up to offset
+		offset := 0
+		if value := r.URL.Query().Get("offset"); value != "" {
+			var err error
+			offset, err = strconv.Atoi(value)
+			if err != nil || offset < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+
 		// Set headers for SSE
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
@@ -93,26 +647,104 @@ func main() {
 			return
 		}
 
-		// Get the request context
+		// Get the request context and subscribe to the events of this chat or prompt only
 		ctx := r.Context()
+		eventCh, done := chatService.StreamEvents(ctx, chatId, promptId)
+
+		// The prompt may have been answered before the client subscribed, so
+		// catch up on the events published until then
+		var prompt chat.Prompt
+		if promptId != "" {
+			if err := chatService.WaitForEvents(ctx); err != nil {
+				return
+			}
+			var err error
+			prompt, err = chatService.GetPrompt(chatId, promptId)
+			if errors.Is(err, chat.ErrChatNotFound) || errors.Is(err, chat.ErrPromptNotFound) {
+				http.Error(w, "Prompt not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to load prompt", http.StatusInternalServerError)
+				return
+			}
+		}
 
 		// Send initial message to confirm connection
-		fmt.Fprintf(w, "event: connected\ndata: Connection established\n\n")
-		flusher.Flush()
+		writeSSE(w, flusher, "connected", "Connection established")
+
+		if prompt.Id() != "" && !prompt.Busy() {
+			writeSSE(w, flusher, string(prompt.Status()), endedMessage(prompt.Status()))
+			writeSSE(w, flusher, "close", "Stream completed")
+			return
+		}
+		// Send the text generated before the client subscribed; tokens it
+		// already has are skipped from then on
+		if text := prompt.StreamingText(); len(text) > offset {
+			writeSSE(w, flusher, "update", html.EscapeString(text[offset:]))
+			offset = len(text)
+		}
+
+		// A queued prompt may have been given its place before the client connected
+		if engineName, position, ok := promptprocessingService.QueuePosition(promptId); ok {
+			writeSSE(w, flusher, "queued", queuedMessage(engineName, position))
+		}
 
 		for {
 			select {
-			case token, ok := <-tokensCh:
-				if !ok {
-					// Channel closed, signal the end of the stream
-					fmt.Fprintf(w, "event: close\ndata: Stream completed\n\n")
-					flusher.Flush()
+			case event := <-eventCh:
+				switch event := event.(type) {
+				case events.GenerationQueued:
+					writeSSE(w, flusher, "queued", queuedMessage(event.Engine, event.Position))
+				case events.GenerationStarted:
+					status := fmt.Sprintf("Generating with %s (%d prompt tokens", event.Model, event.PromptTokens)
+					if event.DroppedMessages > 0 {
+						status += fmt.Sprintf(", %d earlier messages left out", event.DroppedMessages)
+					}
+					writeSSE(w, flusher, "started", html.EscapeString(status+")..."))
+				case events.GenerationRetrying:
+					writeSSE(w, flusher, "retrying", html.EscapeString(fmt.Sprintf("Attempt %d on %s failed (%s), retrying in %s...", event.Attempt, event.Engine, event.Error, event.Delay)))
+				case events.GenerationFallback:
+					writeSSE(w, flusher, "fallback", html.EscapeString(fmt.Sprintf("%s failed (%s), falling back to %s...", event.FromEngine, event.Error, event.ToEngine)))
+				case events.TokensGenerated:
+					text := event.ResponseText
+					if promptId != "" {
+						if seen := offset - event.Offset; seen > 0 {
+							text = text[min(seen, len(text)):]
+						}
+						offset = max(offset, event.Offset+len(event.ResponseText))
+					}
+					if text != "" {
+						// Send the generated token as an SSE message
+						writeSSE(w, flusher, "update", html.EscapeString(text))
+					}
+				case events.GenerationCompleted:
+					tokens := event.CompletionTokens
+					if tokens == 0 {
+						tokens = event.TokenCount
+					}
+					writeSSE(w, flusher, "completed", fmt.Sprintf("Completed: %d tokens in %s", tokens, event.Duration.Round(time.Millisecond)))
+					writeSSE(w, flusher, "close", "Stream completed")
+					return
+				case events.GenerationFailed:
+					writeSSE(w, flusher, "failed", html.EscapeString("Failed: "+event.Error))
+					writeSSE(w, flusher, "close", "Stream completed")
+					return
+				case events.GenerationCancelled:
+					writeSSE(w, flusher, "cancelled", fmt.Sprintf("Cancelled after %d tokens", event.TokenCount))
+					writeSSE(w, flusher, "close", "Stream completed")
 					return
 				}
-
-				// Send the generated token as an SSE message
-				fmt.Fprintf(w, "event: update\ndata: %s\n\n", token)
-				flusher.Flush()
+			case <-done:
+				if ctx.Err() == nil {
+					// Subscription dropped because the client fell behind
+					writeSSE(w, flusher, "close", "Stream lagged behind")
+				}
+				return
+			case <-lc.ShuttingDown():
+				writeSSE(w, flusher, "shutdown", "Server is shutting down")
+				writeSSE(w, flusher, "close", "Stream completed")
+				return
 			case <-ctx.Done():
 				// Client disconnected
 				log.Println("Client disconnected")
@@ -121,6 +753,70 @@ func main() {
 		}
 	})
 
-	fmt.Println("Server is running on http://localhost:3000")
-	http.ListenAndServe(":3000", r)
+	r.Mount("/api/v1", api.New(chatService, lc).Handler())
+	r.Mount("/v1", gateway.New(promptprocessingService, engines, chatService, lc, cfg.Gateway.Record).Handler())
+
+	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+		health := engines.Health()
+		defaultName, _, err := engines.Default()
+		w.Header().Set("Content-Type", "application/json")
+		if h, checked := health[defaultName]; err != nil || (checked && !h.Healthy) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+
+	r.Get("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg.Redacted())
+	})
+
+	r.Get("/debug/subscribers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ps.SubscriberCounts())
+	})
+
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: r}
+
+	// Shutdown steps run in this order once a signal arrives: stop accepting
+	// requests, let running generations finish, then persist what they produced.
+	// Persisting gets a budget of its own so that slow requests or generations
+	// using up the shutdown timeout do not lose the responses.
+	lc.OnShutdown("http server", server.Shutdown)
+	lc.OnShutdown("generations", promptprocessingService.Shutdown)
+	lc.OnShutdownWithTimeout("chat responses", time.Duration(cfg.Server.PersistTimeout), chatService.Flush)
+	lc.OnShutdown("chat storage", func(ctx context.Context) error {
+		return chatRepository.Close()
+	})
+
+	return server, lc, nil
+}
+
+// newRepositories opens the chat and persona storage of the backend
+// selected by name. Closing the chat repository releases both.
+func newRepositories(store, dbPath string) (chat.Repository, persona.Repository, error) {
+	switch store {
+	case "memory":
+		return chat.NewChatRepository(), persona.NewPersonaRepository(), nil
+	case "bolt":
+		chats, err := chat.NewBoltRepository(dbPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return chats, persona.NewBoltRepository(chats.DB()), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown chat store %q", store)
+	}
+}
+
+// probeEngine verifies that an engine can serve its model. Pulling a model may
+// take minutes, so only plain probes are bounded.
+func probeEngine(engines *promptprocessing.EngineRegistry, name string, pull bool) error {
+	ctx := context.Background()
+	if !pull {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+	return engines.Probe(ctx, name, pull)
 }
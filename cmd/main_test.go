@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"demo/chat"
+	"demo/config"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig configures the app with the fake engine configured by options
+// and without background work.
+func testConfig(options map[string]string) config.Config {
+	cfg := config.Default()
+	cfg.Engine.Provider = "fake"
+	cfg.Engine.Options = options
+	cfg.Generation.HealthCheckInterval = 0
+	cfg.Storage.TrashRetention = 0
+	cfg.Titles.Enabled = false
+	return cfg
+}
+
+// newTestServer serves the app with the fake engine configured by options
+// and shuts it down when the test ends.
+func newTestServer(t *testing.T, options map[string]string) *httptest.Server {
+	t.Helper()
+
+	server, lc, err := newServer(testConfig(options))
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	ts := httptest.NewServer(server.Handler)
+	t.Cleanup(func() {
+		ts.Close()
+		if err := lc.Shutdown(); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return ts
+}
+
+// submitPrompt starts a new chat with a prompt through POST /prompt and
+// returns the IDs of the chat and prompt.
+func submitPrompt(t *testing.T, ts *httptest.Server, text string) (chatID, promptID string) {
+	t.Helper()
+
+	resp, err := http.PostForm(ts.URL+"/prompt", url.Values{"prompt": {text}})
+	if err != nil {
+		t.Fatalf("POST /prompt: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /prompt: status %s", resp.Status)
+	}
+
+	var trigger struct {
+		PromptSubmitted struct {
+			ID     string `json:"id"`
+			ChatID string `json:"chatId"`
+		}
+	}
+	if err := json.Unmarshal([]byte(resp.Header.Get("HX-Trigger")), &trigger); err != nil {
+		t.Fatalf("decoding HX-Trigger %q: %v", resp.Header.Get("HX-Trigger"), err)
+	}
+	return trigger.PromptSubmitted.ChatID, trigger.PromptSubmitted.ID
+}
+
+// sseEvent is an event received from an event stream.
+type sseEvent struct {
+	name string
+	data string
+}
+
+// streamPrompt connects to GET /stream for a prompt and returns its events
+// up to the "close" event. onEvent, if not nil, is called with every event
+// as it arrives.
+func streamPrompt(t *testing.T, ts *httptest.Server, chatID, promptID string, onEvent func(sseEvent)) []sseEvent {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := url.Values{"chatId": {chatID}, "promptId": {promptID}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/stream?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("creating stream request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /stream: status %s", resp.Status)
+	}
+
+	var received []sseEvent
+	var event sseEvent
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		case line == "":
+			event.data = strings.Join(data, "\n")
+			received = append(received, event)
+			if onEvent != nil {
+				onEvent(event)
+			}
+			if event.name == "close" {
+				return received
+			}
+			event, data = sseEvent{}, nil
+		}
+	}
+	t.Fatalf("stream ended without a close event: %v (events %v)", scanner.Err(), received)
+	return nil
+}
+
+// streamedText concatenates the text of the update events.
+func streamedText(received []sseEvent) string {
+	var text strings.Builder
+	for _, event := range received {
+		if event.name == "update" {
+			text.WriteString(html.UnescapeString(event.data))
+		}
+	}
+	return text.String()
+}
+
+// terminalEvent returns the event that reported how the generation ended.
+func terminalEvent(t *testing.T, received []sseEvent) sseEvent {
+	t.Helper()
+
+	for _, event := range received {
+		switch event.name {
+		case "completed", "failed", "cancelled":
+			return event
+		}
+	}
+	t.Fatalf("no completed, failed or cancelled event in %v", received)
+	return sseEvent{}
+}
+
+// storedPrompt is a prompt as the JSON API returns it.
+type storedPrompt struct {
+	Status    string `json:"status"`
+	Responses []struct {
+		Text string `json:"text"`
+	} `json:"responses"`
+}
+
+// waitForPrompt polls the JSON API until the prompt has the given status,
+// as the chat service stores generation events in the background.
+func waitForPrompt(t *testing.T, ts *httptest.Server, chatID, promptID, status string) storedPrompt {
+	t.Helper()
+
+	var prompt storedPrompt
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(ts.URL + "/api/v1/chats/" + chatID + "/prompts/" + promptID)
+		if err != nil {
+			t.Fatalf("GET prompt: %v", err)
+		}
+		prompt = storedPrompt{}
+		err = json.NewDecoder(resp.Body).Decode(&prompt)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("decoding prompt: %v", err)
+		}
+		if prompt.Status == status {
+			return prompt
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("prompt status is %q, want %q", prompt.Status, status)
+	return prompt
+}
+
+func TestPromptStreamsScriptedAnswer(t *testing.T) {
+	const script = "Hello from the fake engine, one word at a time."
+	ts := newTestServer(t, map[string]string{"script": script, "delay": "10ms"})
+
+	chatID, promptID := submitPrompt(t, ts, "Say hello")
+	received := streamPrompt(t, ts, chatID, promptID, nil)
+
+	if event := terminalEvent(t, received); event.name != "completed" {
+		t.Errorf("generation ended with %q: %s", event.name, event.data)
+	}
+	if text := streamedText(received); text != script {
+		t.Errorf("streamed %q, want %q", text, script)
+	}
+
+	prompt := waitForPrompt(t, ts, chatID, promptID, "completed")
+	if len(prompt.Responses) != 1 || prompt.Responses[0].Text != script {
+		t.Errorf("stored responses %+v, want one with %q", prompt.Responses, script)
+	}
+}
+
+func TestPromptFailsMidStream(t *testing.T) {
+	ts := newTestServer(t, map[string]string{
+		"script":     "one two three four",
+		"delay":      "10ms",
+		"fail_after": "2",
+		"fail_error": "model crashed",
+	})
+
+	chatID, promptID := submitPrompt(t, ts, "Count to four")
+	received := streamPrompt(t, ts, chatID, promptID, nil)
+
+	event := terminalEvent(t, received)
+	if event.name != "failed" || !strings.Contains(event.data, "model crashed") {
+		t.Errorf("generation ended with %q: %s, want a failure naming the error", event.name, event.data)
+	}
+	if text := streamedText(received); text != "one two " {
+		t.Errorf("streamed %q, want the tokens before the failure", text)
+	}
+
+	prompt := waitForPrompt(t, ts, chatID, promptID, "failed")
+	if len(prompt.Responses) != 1 || prompt.Responses[0].Text != "one two " {
+		t.Errorf("stored responses %+v, want the partial answer", prompt.Responses)
+	}
+}
+
+func TestStreamAfterGenerationEnded(t *testing.T) {
+	const script = "Done already."
+	ts := newTestServer(t, map[string]string{"script": script})
+
+	chatID, promptID := submitPrompt(t, ts, "Be quick")
+	waitForPrompt(t, ts, chatID, promptID, "completed")
+
+	received := streamPrompt(t, ts, chatID, promptID, nil)
+	if event := terminalEvent(t, received); event.name != "completed" {
+		t.Errorf("stream of an ended generation reported %q: %s", event.name, event.data)
+	}
+}
+
+func TestStreamNeedsChat(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"script": "Done already."})
+
+	chatID, promptID := submitPrompt(t, ts, "Be quick")
+	waitForPrompt(t, ts, chatID, promptID, "completed")
+
+	for _, query := range []url.Values{{}, {"promptId": {promptID}}} {
+		resp, err := http.Get(ts.URL + "/stream?" + query.Encode())
+		if err != nil {
+			t.Fatalf("GET /stream: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /stream?%s: status %s, want 400 Bad Request", query.Encode(), resp.Status)
+		}
+	}
+}
+
+func TestPromptIsStopped(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"script": strings.Repeat("word ", 100), "delay": "50ms"})
+
+	chatID, promptID := submitPrompt(t, ts, "Talk for a while")
+	stopped := false
+	received := streamPrompt(t, ts, chatID, promptID, func(event sseEvent) {
+		if event.name != "update" || stopped {
+			return
+		}
+		stopped = true
+		resp, err := http.PostForm(ts.URL+"/stop", url.Values{"promptId": {promptID}})
+		if err != nil {
+			t.Errorf("POST /stop: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("POST /stop: status %s", resp.Status)
+		}
+	})
+
+	if event := terminalEvent(t, received); event.name != "cancelled" {
+		t.Errorf("generation ended with %q: %s, want it cancelled", event.name, event.data)
+	}
+	text := streamedText(received)
+	if text == "" || len(text) >= len(strings.Repeat("word ", 100)) {
+		t.Errorf("streamed %q, want part of the answer", text)
+	}
+
+	prompt := waitForPrompt(t, ts, chatID, promptID, "cancelled")
+	if len(prompt.Responses) != 1 || prompt.Responses[0].Text != text {
+		t.Errorf("stored responses %+v, want one with the streamed %q", prompt.Responses, text)
+	}
+}
+
+func TestGatewayChatCompletion(t *testing.T) {
+	ts := newTestServer(t, map[string]string{"script": "one two three four"})
+
+	body := `{"model": "llama3.1:8b", "messages": [{"role": "user", "content": "Count"}], "max_tokens": 2}`
+	resp, err := http.Post(ts.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /v1/chat/completions: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /v1/chat/completions: status %s", resp.Status)
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatalf("decoding completion: %v", err)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(completion.Choices))
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Content != "one two " || choice.FinishReason != "length" || completion.Usage.CompletionTokens != 2 {
+		t.Errorf("answer %q ended with %q after %d tokens, want %q cut off after 2", choice.Message.Content, choice.FinishReason, completion.Usage.CompletionTokens, "one two ")
+	}
+}
+
+func TestShutdownPersistsAnswers(t *testing.T) {
+	cfg := testConfig(map[string]string{"script": strings.Repeat("word ", 500), "delay": "20ms"})
+	cfg.Engine.MaxConcurrent = 2
+	cfg.Server.ShutdownTimeout = config.Duration(300 * time.Millisecond)
+	cfg.Storage.Backend = "bolt"
+	cfg.Storage.DBPath = filepath.Join(t.TempDir(), "chats.db")
+
+	server, lc, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	// Serve through the app's own server, so that shutting it down waits
+	// for the requests in flight
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = server
+	ts.Start()
+	defer ts.Close()
+
+	// A gateway call streaming until the end of the script
+	body := `{"model": "` + cfg.Engine.Model + `", "messages": [{"role": "user", "content": "Talk"}], "stream": true}`
+	resp, err := http.Post(ts.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /v1/chat/completions: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /v1/chat/completions: status %s", resp.Status)
+	}
+	called := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(resp.Body)
+		called <- string(data)
+	}()
+
+	chatID, promptID := submitPrompt(t, ts, "Talk")
+	waitForPrompt(t, ts, chatID, promptID, "generating")
+	time.Sleep(100 * time.Millisecond)
+
+	// A connection the client dialled but never sent a request on would hold
+	// up the server for seconds, as it does not count as idle yet
+	http.DefaultClient.CloseIdleConnections()
+	started := time.Now()
+	if err := lc.Shutdown(); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took %s", elapsed)
+	}
+	select {
+	case data := <-called:
+		if !strings.Contains(data, "shutting_down") {
+			t.Errorf("gateway call ended with %q, want a shutdown error", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("gateway call still running after shutdown")
+	}
+
+	repo, err := chat.NewBoltRepository(cfg.Storage.DBPath)
+	if err != nil {
+		t.Fatalf("reopening the database: %v", err)
+	}
+	defer repo.Close()
+	c, err := repo.GetChat(chatID)
+	if err != nil {
+		t.Fatalf("GetChat: %v", err)
+	}
+	prompt := c.Prompts()[0]
+	if prompt.Status() != chat.PromptCancelled {
+		t.Errorf("stored prompt status is %q, want %q", prompt.Status(), chat.PromptCancelled)
+	}
+	responses := prompt.Responses()
+	if len(responses) != 1 || !strings.HasPrefix(responses[0].Text(), "word word ") {
+		t.Errorf("stored responses %+v, want the words generated before shutdown", responses)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"demo/chat"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseSettingsForm reads chat settings from a submitted settings form.
+// Empty fields leave the setting unset.
+func parseSettingsForm(r *http.Request) (chat.Settings, error) {
+	var settings chat.Settings
+	var err error
+
+	settings.Model = strings.TrimSpace(r.FormValue("model"))
+	if settings.Temperature, err = formFloat(r, "temperature"); err != nil {
+		return settings, err
+	}
+	if settings.TopP, err = formFloat(r, "top_p"); err != nil {
+		return settings, err
+	}
+	if settings.TopK, err = formInt(r, "top_k"); err != nil {
+		return settings, err
+	}
+	if settings.MaxTokens, err = formInt(r, "max_tokens"); err != nil {
+		return settings, err
+	}
+	if settings.Seed, err = formInt(r, "seed"); err != nil {
+		return settings, err
+	}
+	if settings.RepeatPenalty, err = formFloat(r, "repeat_penalty"); err != nil {
+		return settings, err
+	}
+	for _, stop := range strings.Split(r.FormValue("stop"), "\n") {
+		if stop = strings.TrimRight(stop, "\r"); stop != "" {
+			settings.Stop = append(settings.Stop, stop)
+		}
+	}
+
+	return settings, nil
+}
+
+func formFloat(r *http.Request, name string) (*float64, error) {
+	value := strings.TrimSpace(r.FormValue(name))
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", name)
+	}
+	return &f, nil
+}
+
+func formInt(r *http.Request, name string) (*int, error) {
+	value := strings.TrimSpace(r.FormValue(name))
+	if value == "" {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a whole number", name)
+	}
+	return &i, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"demo/chat"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// writeSSE writes a single server-sent event and flushes it to the client.
+// Multi-line data is split across several data fields as the protocol requires.
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+	flusher.Flush()
+}
+
+// queuedMessage describes the place of a prompt waiting for its engine.
+func queuedMessage(engineName string, position int) string {
+	return html.EscapeString(fmt.Sprintf("Waiting for %s: you are #%d in line", engineName, position))
+}
+
+// endedMessage describes how the answer to a prompt ended when its
+// generation was over before the client connected.
+func endedMessage(status chat.PromptStatus) string {
+	switch status {
+	case chat.PromptFailed:
+		return "Failed"
+	case chat.PromptCancelled:
+		return "Cancelled"
+	default:
+		return "Completed"
+	}
+}
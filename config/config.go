@@ -0,0 +1,506 @@
+// Package config resolves the application settings from defaults, a YAML
+// file, environment variables and command-line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"demo/promptprocessing"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the resolved application configuration.
+type Config struct {
+	Server  ServerConfig  `yaml:"server" json:"server"`
+	Storage StorageConfig `yaml:"storage" json:"storage"`
+	Engine  EngineConfig  `yaml:"engine" json:"engine"`
+	// Fallbacks are tried in order when the engine fails before streaming a token.
+	Fallbacks  []EngineConfig   `yaml:"fallbacks" json:"fallbacks"`
+	Generation GenerationConfig `yaml:"generation" json:"generation"`
+	Titles     TitleConfig      `yaml:"titles" json:"titles"`
+	Gateway    GatewayConfig    `yaml:"gateway" json:"gateway"`
+}
+
+// Duration is a time.Duration written as a string such as "30s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ServerConfig configures the HTTP server.
+type ServerConfig struct {
+	// Addr is the address the server listens on, e.g. ":3000".
+	Addr string `yaml:"addr" json:"addr"`
+	// IndexPath is the HTML page served at "/".
+	IndexPath string `yaml:"index" json:"index"`
+	// ShutdownTimeout bounds a graceful shutdown, apart from persisting the
+	// chat responses generated until it began.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	// PersistTimeout bounds persisting those responses, however long the
+	// rest of the shutdown took.
+	PersistTimeout Duration `yaml:"persist_timeout" json:"persist_timeout"`
+}
+
+// StorageConfig selects where chats are stored.
+type StorageConfig struct {
+	// Backend is "memory" or "bolt".
+	Backend string `yaml:"backend" json:"backend"`
+	// DBPath is the bolt database file.
+	DBPath string `yaml:"db" json:"db"`
+	// TrashRetention is how long deleted chats stay in the trash; 0 keeps them until purged by hand.
+	TrashRetention Duration `yaml:"trash_retention" json:"trash_retention"`
+}
+
+// EngineConfig configures the LLM engine.
+type EngineConfig struct {
+	Provider string            `yaml:"provider" json:"provider"`
+	Model    string            `yaml:"model" json:"model"`
+	URL      string            `yaml:"url" json:"url"`
+	APIKey   string            `yaml:"api_key" json:"api_key"`
+	Options  map[string]string `yaml:"options" json:"options"`
+	// MaxConcurrent is how many generations the engine runs at once.
+	MaxConcurrent int `yaml:"max_concurrent" json:"max_concurrent"`
+	// SkipProbe skips verifying at startup that the server has the model.
+	SkipProbe bool `yaml:"skip_probe" json:"skip_probe"`
+	// Pull pulls the model onto the server at startup if it is missing.
+	Pull bool `yaml:"pull" json:"pull"`
+}
+
+// EngineConfig returns the configuration the engine registry creates the engine from.
+func (e EngineConfig) EngineConfig() promptprocessing.EngineConfig {
+	return promptprocessing.EngineConfig{
+		Provider: e.Provider,
+		Model:    e.Model,
+		URL:      e.URL,
+		APIKey:   e.APIKey,
+		Options:  e.Options,
+	}
+}
+
+// validate reports the invalid values of an engine, naming it as what.
+func (e EngineConfig) validate(what string) []error {
+	var errs []error
+	if !slices.Contains(promptprocessing.Providers(), e.Provider) {
+		errs = append(errs, fmt.Errorf("%s: unknown provider %q, want one of %v", what, e.Provider, promptprocessing.Providers()))
+	}
+	if e.Model == "" {
+		errs = append(errs, fmt.Errorf("%s: model is required", what))
+	}
+	if e.MaxConcurrent < 1 {
+		errs = append(errs, fmt.Errorf("%s: max concurrent generations must be at least 1", what))
+	}
+	if e.Provider == "openai" && e.URL == "" {
+		errs = append(errs, fmt.Errorf("%s: the openai provider requires an LLM server URL", what))
+	}
+	return errs
+}
+
+// redacted returns a copy of the engine configuration with credentials masked.
+func (e EngineConfig) redacted() EngineConfig {
+	if e.APIKey != "" {
+		e.APIKey = "REDACTED"
+	}
+
+	// Engine options may carry credentials too
+	options := make(map[string]string, len(e.Options))
+	for key, value := range e.Options {
+		if isSecretOption(key) {
+			value = "REDACTED"
+		}
+		options[key] = value
+	}
+	e.Options = options
+	return e
+}
+
+// GenerationConfig bounds generations and configures recovering from failures.
+// A zero timeout disables it.
+type GenerationConfig struct {
+	FirstTokenTimeout Duration `yaml:"first_token_timeout" json:"first_token_timeout"`
+	TotalTimeout      Duration `yaml:"total_timeout" json:"total_timeout"`
+	MaxRetries        int      `yaml:"max_retries" json:"max_retries"`
+	RetryBackoff      Duration `yaml:"retry_backoff" json:"retry_backoff"`
+	// HealthCheckInterval is how often the engines' backends are checked.
+	HealthCheckInterval Duration `yaml:"health_check_interval" json:"health_check_interval"`
+	// ContextLimits sets the context window size in tokens of models, by name
+	// such as "llama3.1:8b" or family such as "llama3.1", instead of the size
+	// reported by the engine or known for the family.
+	ContextLimits map[string]int `yaml:"context_limits" json:"context_limits"`
+}
+
+// TitleConfig controls how chats are named after their first answer.
+type TitleConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Engine is the configured engine, named provider/model, that writes the
+	// titles; empty uses the default engine.
+	Engine string `yaml:"engine" json:"engine"`
+	// Model replaces the engine's model for titles, e.g. with a cheaper one.
+	Model string `yaml:"model" json:"model"`
+}
+
+// GatewayConfig controls the OpenAI-compatible endpoints under /v1.
+type GatewayConfig struct {
+	// Record stores every completion as a chat, for history and audit.
+	Record bool `yaml:"record" json:"record"`
+}
+
+// Policy returns the generation policy of the configuration.
+func (c Config) Policy() promptprocessing.GenerationPolicy {
+	policy := promptprocessing.GenerationPolicy{
+		FirstTokenTimeout: time.Duration(c.Generation.FirstTokenTimeout),
+		TotalTimeout:      time.Duration(c.Generation.TotalTimeout),
+		MaxRetries:        c.Generation.MaxRetries,
+		RetryBackoff:      time.Duration(c.Generation.RetryBackoff),
+	}
+	for _, fallback := range c.Fallbacks {
+		policy.Fallbacks = append(policy.Fallbacks, fallback.EngineConfig().Name())
+	}
+	return policy
+}
+
+// Default returns the configuration used when nothing overrides it.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:            ":3000",
+			IndexPath:       "index.html",
+			ShutdownTimeout: Duration(30 * time.Second),
+			PersistTimeout:  Duration(10 * time.Second),
+		},
+		Storage: StorageConfig{
+			Backend:        "memory",
+			DBPath:         "chats.db",
+			TrashRetention: Duration(30 * 24 * time.Hour),
+		},
+		Engine: EngineConfig{
+			Provider:      "ollama",
+			Model:         "llama3.1:8b",
+			Options:       make(map[string]string),
+			MaxConcurrent: promptprocessing.DefaultMaxConcurrent,
+		},
+		Generation: GenerationConfig{
+			FirstTokenTimeout:   Duration(2 * time.Minute),
+			TotalTimeout:        Duration(10 * time.Minute),
+			MaxRetries:          2,
+			RetryBackoff:        Duration(time.Second),
+			HealthCheckInterval: Duration(30 * time.Second),
+		},
+		Titles: TitleConfig{
+			Enabled: true,
+		},
+	}
+}
+
+// setting is a configuration value that can be set from the environment and the command line.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	// field returns a pointer to the value, a *string, an *int, a *bool or a *Duration.
+	field func(c *Config) any
+}
+
+// set parses value into the setting's field of c.
+func (s setting) set(c *Config, value string) error {
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a whole number", s.flag)
+		}
+		*field = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", s.flag)
+		}
+		*field = b
+	case *Duration:
+		if err := field.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("%s must be a duration such as 30s", s.flag)
+		}
+	}
+	return nil
+}
+
+// get formats the setting's field of c.
+func (s setting) get(c *Config) string {
+	switch field := s.field(c).(type) {
+	case *string:
+		return *field
+	case *int:
+		return strconv.Itoa(*field)
+	case *bool:
+		return strconv.FormatBool(*field)
+	case *Duration:
+		return field.String()
+	}
+	return ""
+}
+
+var settings = []setting{
+	{"addr", "CHAT_ADDR", "address the HTTP server listens on", func(c *Config) any { return &c.Server.Addr }},
+	{"index", "CHAT_INDEX", "HTML page served at /", func(c *Config) any { return &c.Server.IndexPath }},
+	{"shutdown-timeout", "CHAT_SHUTDOWN_TIMEOUT", "how long a graceful shutdown may take before persisting responses", func(c *Config) any { return &c.Server.ShutdownTimeout }},
+	{"persist-timeout", "CHAT_PERSIST_TIMEOUT", "how long persisting responses may take on shutdown", func(c *Config) any { return &c.Server.PersistTimeout }},
+	{"store", "CHAT_STORE", `chat storage backend: "memory" or "bolt"`, func(c *Config) any { return &c.Storage.Backend }},
+	{"db", "CHAT_DB", "path of the bolt chat database", func(c *Config) any { return &c.Storage.DBPath }},
+	{"trash-retention", "CHAT_TRASH_RETENTION", "how long deleted chats stay in the trash; 0 keeps them", func(c *Config) any { return &c.Storage.TrashRetention }},
+	{"engine", "CHAT_ENGINE", fmt.Sprintf("LLM engine provider: %v", promptprocessing.Providers()), func(c *Config) any { return &c.Engine.Provider }},
+	{"model", "CHAT_MODEL", "model the engine generates with", func(c *Config) any { return &c.Engine.Model }},
+	{"llm-url", "CHAT_LLM_URL", `LLM server URL; for "openai" the API root, e.g. http://localhost:8080/v1`, func(c *Config) any { return &c.Engine.URL }},
+	{"max-concurrent", "CHAT_MAX_CONCURRENT", "how many generations the engine runs at once; further prompts are queued", func(c *Config) any { return &c.Engine.MaxConcurrent }},
+	{"first-token-timeout", "CHAT_FIRST_TOKEN_TIMEOUT", "how long an attempt may take to stream its first token; 0 disables", func(c *Config) any { return &c.Generation.FirstTokenTimeout }},
+	{"total-timeout", "CHAT_TOTAL_TIMEOUT", "how long a generation may take in total; 0 disables", func(c *Config) any { return &c.Generation.TotalTimeout }},
+	{"max-retries", "CHAT_MAX_RETRIES", "how often an engine is retried after a transient failure before its first token", func(c *Config) any { return &c.Generation.MaxRetries }},
+	{"retry-backoff", "CHAT_RETRY_BACKOFF", "wait before the first retry, doubled for each one after", func(c *Config) any { return &c.Generation.RetryBackoff }},
+	{"skip-probe", "CHAT_SKIP_PROBE", "do not verify at startup that the LLM server has the model", func(c *Config) any { return &c.Engine.SkipProbe }},
+	{"pull-model", "CHAT_PULL_MODEL", "pull the model at startup if the LLM server does not have it", func(c *Config) any { return &c.Engine.Pull }},
+	{"health-interval", "CHAT_HEALTH_INTERVAL", "how often the LLM servers are health checked; 0 disables", func(c *Config) any { return &c.Generation.HealthCheckInterval }},
+	{"titles", "CHAT_TITLES", "name chats after their first answer", func(c *Config) any { return &c.Titles.Enabled }},
+	{"title-engine", "CHAT_TITLE_ENGINE", "configured engine (provider/model) writing chat titles; empty uses the default engine", func(c *Config) any { return &c.Titles.Engine }},
+	{"title-model", "CHAT_TITLE_MODEL", "model chat titles are written with, e.g. a cheaper one; empty uses the engine's", func(c *Config) any { return &c.Titles.Model }},
+	{"gateway-record", "CHAT_GATEWAY_RECORD", "store every call to the OpenAI-compatible /v1 endpoints as a chat", func(c *Config) any { return &c.Gateway.Record }},
+	{"llm-api-key", "LLM_API_KEY", "API key sent to the LLM server, if it needs one", func(c *Config) any { return &c.Engine.APIKey }},
+}
+
+// flagValue holds a setting given on the command line until it is parsed
+// into the configuration.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+func (v *flagValue) Set(value string) error {
+	v.value = value
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as a bare -flag.
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+const (
+	configFlag = "config"
+	configEnv  = "CHAT_CONFIG"
+
+	engineOptionFlag = "engine-option"
+	engineOptionsEnv = "CHAT_ENGINE_OPTIONS"
+)
+
+// Load resolves the configuration from, in increasing order of precedence,
+// the defaults, the YAML file named by -config or CHAT_CONFIG, the environment
+// and the command-line arguments, then validates it.
+func Load(args []string, getenv func(string) string) (Config, error) {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	configPath := fs.String(configFlag, getenv(configEnv), "path of a YAML configuration file (env "+configEnv+")")
+
+	defaults := Default()
+	flagValues := make([]*flagValue, len(settings))
+	for i, s := range settings {
+		_, isBool := s.field(&defaults).(*bool)
+		flagValues[i] = &flagValue{value: s.get(&defaults), isBool: isBool}
+		fs.Var(flagValues[i], s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	flagOptions := make(map[string]string)
+	fs.Func(engineOptionFlag, "provider-specific engine option as key=value; may be repeated (env "+engineOptionsEnv+", comma-separated)", func(option string) error {
+		return addOption(flagOptions, option)
+	})
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Environment variables override the file
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(&cfg, value); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	if value := getenv(engineOptionsEnv); value != "" {
+		for _, option := range strings.Split(value, ",") {
+			if err := addOption(cfg.Engine.Options, option); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", engineOptionsEnv, err)
+			}
+		}
+	}
+
+	// Flags given on the command line override everything else
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for i, s := range settings {
+			if s.flag == f.Name && flagErr == nil {
+				flagErr = s.set(&cfg, flagValues[i].value)
+			}
+		}
+	})
+	if flagErr != nil {
+		return Config{}, flagErr
+	}
+	for key, value := range flagOptions {
+		cfg.Engine.Options[key] = value
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides the configuration with the values set in a YAML file.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	if c.Engine.Options == nil {
+		c.Engine.Options = make(map[string]string)
+	}
+	for i := range c.Fallbacks {
+		if c.Fallbacks[i].MaxConcurrent == 0 {
+			c.Fallbacks[i].MaxConcurrent = promptprocessing.DefaultMaxConcurrent
+		}
+	}
+	return nil
+}
+
+func addOption(options map[string]string, option string) error {
+	key, value, ok := strings.Cut(option, "=")
+	if !ok {
+		return fmt.Errorf("engine option %q is not key=value", option)
+	}
+	options[strings.TrimSpace(key)] = value
+	return nil
+}
+
+// Validate reports every invalid value of the configuration.
+func (c Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server address %q: %w", c.Server.Addr, err))
+	}
+	if info, err := os.Stat(c.Server.IndexPath); err != nil {
+		errs = append(errs, fmt.Errorf("index page: %w", err))
+	} else if info.IsDir() {
+		errs = append(errs, fmt.Errorf("index page %s is a directory", c.Server.IndexPath))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown timeout must be positive"))
+	}
+	if c.Server.PersistTimeout <= 0 {
+		errs = append(errs, errors.New("persist timeout must be positive"))
+	}
+
+	switch c.Storage.Backend {
+	case "memory":
+	case "bolt":
+		if c.Storage.DBPath == "" {
+			errs = append(errs, errors.New("the bolt store requires a database path"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown chat store %q", c.Storage.Backend))
+	}
+	if c.Storage.TrashRetention < 0 {
+		errs = append(errs, errors.New("trash retention must not be negative"))
+	}
+
+	errs = append(errs, c.Engine.validate("engine")...)
+	names := map[string]bool{c.Engine.EngineConfig().Name(): true}
+	for i, fallback := range c.Fallbacks {
+		what := fmt.Sprintf("fallback engine %d", i+1)
+		errs = append(errs, fallback.validate(what)...)
+		if name := fallback.EngineConfig().Name(); names[name] {
+			errs = append(errs, fmt.Errorf("%s: %s is configured twice", what, name))
+		} else {
+			names[name] = true
+		}
+	}
+
+	if c.Generation.FirstTokenTimeout < 0 || c.Generation.TotalTimeout < 0 || c.Generation.RetryBackoff < 0 || c.Generation.HealthCheckInterval < 0 {
+		errs = append(errs, errors.New("generation timeouts, backoff and health check interval must not be negative"))
+	}
+	if c.Titles.Enabled && c.Titles.Engine != "" && !names[c.Titles.Engine] {
+		errs = append(errs, fmt.Errorf("title engine %s is not configured", c.Titles.Engine))
+	}
+	if c.Generation.MaxRetries < 0 {
+		errs = append(errs, errors.New("generation max retries must not be negative"))
+	}
+	for model, limit := range c.Generation.ContextLimits {
+		if limit < 1 {
+			errs = append(errs, fmt.Errorf("context limit of %s must be at least 1", model))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets masked, safe to expose.
+func (c Config) Redacted() Config {
+	redacted := c
+	redacted.Engine = c.Engine.redacted()
+	redacted.Fallbacks = make([]EngineConfig, 0, len(c.Fallbacks))
+	for _, fallback := range c.Fallbacks {
+		redacted.Fallbacks = append(redacted.Fallbacks, fallback.redacted())
+	}
+	return redacted
+}
+
+// isSecretOption reports whether an engine option looks like a credential.
+func isSecretOption(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"key", "secret", "token", "password"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeFile writes content to a file in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	index := writeFile(t, dir, "index.html", "<html></html>")
+	file := writeFile(t, dir, "config.yaml", `
+server:
+  addr: ":4000"
+  shutdown_timeout: 10s
+engine:
+  options:
+    a: file
+    b: file
+generation:
+  max_retries: 5
+titles:
+  enabled: false
+`)
+	other := writeFile(t, dir, "other.yaml", `
+server:
+  addr: ":7000"
+`)
+
+	type want struct {
+		addr     string
+		timeout  time.Duration
+		retries  int
+		titles   bool
+		options  map[string]string
+		provider string
+	}
+	defaults := want{":3000", 30 * time.Second, 2, true, map[string]string{}, "ollama"}
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want want
+	}{
+		{
+			name: "defaults",
+			want: defaults,
+		},
+		{
+			name: "file overrides defaults",
+			args: []string{"-config", file},
+			want: want{":4000", 10 * time.Second, 5, false, map[string]string{"a": "file", "b": "file"}, "ollama"},
+		},
+		{
+			name: "file named by the environment",
+			env:  map[string]string{"CHAT_CONFIG": file},
+			want: want{":4000", 10 * time.Second, 5, false, map[string]string{"a": "file", "b": "file"}, "ollama"},
+		},
+		{
+			name: "flag names another file than the environment",
+			env:  map[string]string{"CHAT_CONFIG": file},
+			args: []string{"-config", other},
+			want: want{":7000", 30 * time.Second, 2, true, map[string]string{}, "ollama"},
+		},
+		{
+			name: "environment overrides file",
+			env: map[string]string{
+				"CHAT_ADDR":             ":5000",
+				"CHAT_SHUTDOWN_TIMEOUT": "20s",
+				"CHAT_TITLES":           "true",
+				"CHAT_ENGINE_OPTIONS":   "b=env,c=env",
+				"CHAT_ENGINE":           "fake",
+			},
+			args: []string{"-config", file},
+			want: want{":5000", 20 * time.Second, 5, true, map[string]string{"a": "file", "b": "env", "c": "env"}, "fake"},
+		},
+		{
+			name: "flags override environment and file",
+			env: map[string]string{
+				"CHAT_ADDR":           ":5000",
+				"CHAT_MAX_RETRIES":    "7",
+				"CHAT_TITLES":         "true",
+				"CHAT_ENGINE_OPTIONS": "b=env,c=env",
+			},
+			args: []string{"-config", file, "-addr", ":6000", "-max-retries", "1", "-titles=false", "-engine-option", "c=flag"},
+			want: want{":6000", 10 * time.Second, 1, false, map[string]string{"a": "file", "b": "env", "c": "flag"}, "ollama"},
+		},
+		{
+			name: "flag set to the default still overrides",
+			env:  map[string]string{"CHAT_ADDR": ":5000"},
+			args: []string{"-addr", ":3000"},
+			want: defaults,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string {
+				if key == "CHAT_INDEX" {
+					return index
+				}
+				return tt.env[key]
+			}
+			cfg, err := Load(append([]string{"chat"}, tt.args...), getenv)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+
+			got := want{
+				addr:     cfg.Server.Addr,
+				timeout:  time.Duration(cfg.Server.ShutdownTimeout),
+				retries:  cfg.Generation.MaxRetries,
+				titles:   cfg.Titles.Enabled,
+				options:  cfg.Engine.Options,
+				provider: cfg.Engine.Provider,
+			}
+			if got.addr != tt.want.addr || got.timeout != tt.want.timeout || got.retries != tt.want.retries ||
+				got.titles != tt.want.titles || got.provider != tt.want.provider || !maps.Equal(got.options, tt.want.options) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	index := writeFile(t, t.TempDir(), "index.html", "<html></html>")
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{"malformed duration", map[string]string{"CHAT_SHUTDOWN_TIMEOUT": "soon"}, nil},
+		{"persist timeout not positive", nil, []string{"-persist-timeout", "0s"}},
+		{"malformed number flag", nil, []string{"-max-retries", "many"}},
+		{"unknown provider", map[string]string{"CHAT_ENGINE": "magic"}, nil},
+		{"engine option without value", nil, []string{"-engine-option", "script"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string {
+				if key == "CHAT_INDEX" {
+					return index
+				}
+				return tt.env[key]
+			}
+			if _, err := Load(append([]string{"chat"}, tt.args...), getenv); err == nil {
+				t.Error("Load accepted an invalid configuration")
+			}
+		})
+	}
+}
+
+func TestRedactedHidesSecrets(t *testing.T) {
+	secrets := []string{"sk-engine-key", "sk-fallback-key", "token-value", "hunter2", "client-secret"}
+
+	dir := t.TempDir()
+	index := writeFile(t, dir, "index.html", "<html></html>")
+	file := writeFile(t, dir, "config.yaml", fmt.Sprintf(`
+engine:
+  options:
+    api_token: %s
+    Password: %s
+    num_ctx: "4096"
+fallbacks:
+  - provider: openai
+    model: gpt-4o-mini
+    url: https://api.openai.com/v1
+    api_key: %s
+    options:
+      client_secret: %s
+`, secrets[2], secrets[3], secrets[1], secrets[4]))
+	getenv := func(key string) string {
+		switch key {
+		case "CHAT_INDEX":
+			return index
+		case "LLM_API_KEY":
+			return secrets[0]
+		}
+		return ""
+	}
+	cfg, err := Load([]string{"chat", "-config", file}, getenv)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	redacted := cfg.Redacted()
+	jsonData, err := json.Marshal(redacted)
+	if err != nil {
+		t.Fatalf("encoding JSON: %v", err)
+	}
+	yamlData, err := yaml.Marshal(redacted)
+	if err != nil {
+		t.Fatalf("encoding YAML: %v", err)
+	}
+	outputs := map[string]string{
+		"JSON":   string(jsonData),
+		"YAML":   string(yamlData),
+		"%+v":    fmt.Sprintf("%+v", redacted),
+		"string": fmt.Sprint(redacted),
+	}
+	for format, output := range outputs {
+		for _, secret := range secrets {
+			if strings.Contains(output, secret) {
+				t.Errorf("%s output contains the secret %q: %s", format, secret, output)
+			}
+		}
+		if !strings.Contains(output, "4096") {
+			t.Errorf("%s output lost the option that is not a secret: %s", format, output)
+		}
+	}
+
+	// Redacting leaves the configuration in use untouched
+	if cfg.Engine.APIKey != secrets[0] || cfg.Engine.Options["api_token"] != secrets[2] ||
+		cfg.Fallbacks[0].APIKey != secrets[1] || cfg.Fallbacks[0].Options["client_secret"] != secrets[4] {
+		t.Errorf("Redacted changed the configuration: %+v", cfg)
+	}
+}
@@ -0,0 +1,254 @@
+package events
+
+import "time"
+
+// Names of the events published on the bus.
+const (
+	ChatCreatedEvent     = "ChatCreated"
+	ChatRenamedEvent     = "ChatRenamed"
+	ChatDeletedEvent     = "ChatDeleted"
+	ChatRestoredEvent    = "ChatRestored"
+	ChatArchivedEvent    = "ChatArchived"
+	ChatPurgedEvent      = "ChatPurged"
+	PromptSubmittedEvent = "PromptSubmitted"
+	TokensGeneratedEvent = "TokensGenerated"
+
+	GenerationQueuedEvent    = "GenerationQueued"
+	GenerationStartedEvent   = "GenerationStarted"
+	GenerationRetryingEvent  = "GenerationRetrying"
+	GenerationFallbackEvent  = "GenerationFallback"
+	GenerationCompletedEvent = "GenerationCompleted"
+	GenerationFailedEvent    = "GenerationFailed"
+	GenerationCancelledEvent = "GenerationCancelled"
+
+	StopRequestedEvent       = "StopRequested"
+	ChatSettingsUpdatedEvent = "ChatSettingsUpdated"
+	ResponsePreferredEvent   = "ResponsePreferred"
+
+	PersonaCreatedEvent = "PersonaCreated"
+	PersonaUpdatedEvent = "PersonaUpdated"
+	PersonaDeletedEvent = "PersonaDeleted"
+)
+
+// ChatEvents lists the events that change which chats are listed or how.
+var ChatEvents = []string{
+	ChatCreatedEvent,
+	ChatRenamedEvent,
+	ChatDeletedEvent,
+	ChatRestoredEvent,
+	ChatArchivedEvent,
+	ChatPurgedEvent,
+}
+
+// GenerationEvents lists the events published while a prompt is answered, in
+// the order a subscriber should expect them.
+var GenerationEvents = []string{
+	GenerationQueuedEvent,
+	GenerationStartedEvent,
+	GenerationRetryingEvent,
+	GenerationFallbackEvent,
+	TokensGeneratedEvent,
+	GenerationCompletedEvent,
+	GenerationFailedEvent,
+	GenerationCancelledEvent,
+}
+
+// ChatCreated is published when a new chat is created.
+type ChatCreated struct {
+	ChatID    string
+	Name      string
+	PersonaID string
+}
+
+func (ChatCreated) EventName() string { return ChatCreatedEvent }
+
+// ChatRenamed is published when a chat is renamed.
+type ChatRenamed struct {
+	ChatID  string
+	NewName string
+}
+
+func (ChatRenamed) EventName() string { return ChatRenamedEvent }
+
+// ChatDeleted is published when a chat is moved to the trash.
+type ChatDeleted struct {
+	ChatID string
+}
+
+func (ChatDeleted) EventName() string { return ChatDeletedEvent }
+
+// ChatRestored is published when a chat is taken back out of the trash.
+type ChatRestored struct {
+	ChatID string
+}
+
+func (ChatRestored) EventName() string { return ChatRestoredEvent }
+
+// ChatArchived is published when a chat is archived or unarchived.
+type ChatArchived struct {
+	ChatID   string
+	Archived bool
+}
+
+func (ChatArchived) EventName() string { return ChatArchivedEvent }
+
+// ChatPurged is published when a chat is removed from the trash for good.
+type ChatPurged struct {
+	ChatID string
+}
+
+func (ChatPurged) EventName() string { return ChatPurgedEvent }
+
+// ChatSettingsUpdated is published when the generation settings of a chat change.
+type ChatSettingsUpdated struct {
+	ChatID string
+}
+
+func (ChatSettingsUpdated) EventName() string { return ChatSettingsUpdatedEvent }
+
+// PromptSubmitted is published when a prompt is added to a chat.
+type PromptSubmitted struct {
+	ChatID     string
+	PromptID   string
+	PromptText string
+}
+
+func (PromptSubmitted) EventName() string { return PromptSubmittedEvent }
+
+// ResponsePreferred is published when one of the responses to a prompt is
+// chosen as its answer in the chat history.
+type ResponsePreferred struct {
+	ChatID     string
+	PromptID   string
+	ResponseID string
+}
+
+func (ResponsePreferred) EventName() string { return ResponsePreferredEvent }
+
+// TokensGenerated is published for every chunk of text streamed by the model.
+type TokensGenerated struct {
+	ChatID       string
+	PromptID     string
+	ResponseText string
+	Offset       int // length in bytes of the response text before these tokens
+}
+
+func (TokensGenerated) EventName() string { return TokensGeneratedEvent }
+
+// GenerationQueued is published when a prompt waits for its engine to be free,
+// and again whenever its place in the queue changes. Position 1 is next in line.
+type GenerationQueued struct {
+	ChatID   string
+	PromptID string
+	Engine   string
+	Position int
+}
+
+func (GenerationQueued) EventName() string { return GenerationQueuedEvent }
+
+// GenerationStarted is published when the model starts answering a prompt.
+// The token counts describe the conversation the model actually received,
+// after older messages were dropped to fit its context window.
+type GenerationStarted struct {
+	ChatID          string
+	PromptID        string
+	StartedAt       time.Time
+	Engine          string
+	Model           string
+	ContextLimit    int
+	PromptTokens    int
+	DroppedMessages int
+	DroppedTokens   int
+}
+
+func (GenerationStarted) EventName() string { return GenerationStartedEvent }
+
+// GenerationRetrying is published when an attempt failed before streaming a
+// token and the engine is tried again after Delay.
+type GenerationRetrying struct {
+	ChatID   string
+	PromptID string
+	Engine   string
+	Attempt  int // the attempt that failed, starting at 1
+	Delay    time.Duration
+	Error    string
+}
+
+func (GenerationRetrying) EventName() string { return GenerationRetryingEvent }
+
+// GenerationFallback is published when an engine failed before streaming a
+// token and the prompt moves on to the next engine of the fallback chain.
+type GenerationFallback struct {
+	ChatID     string
+	PromptID   string
+	FromEngine string
+	ToEngine   string
+	Error      string
+}
+
+func (GenerationFallback) EventName() string { return GenerationFallbackEvent }
+
+// GenerationCompleted is published when the model finished answering a prompt.
+// TokenCount is how many chunks of text were streamed. FinishReason ("stop"
+// or "length") and the token counts are as the engine reported them, and
+// empty or zero if it did not.
+type GenerationCompleted struct {
+	ChatID           string
+	PromptID         string
+	TokenCount       int
+	Duration         time.Duration
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func (GenerationCompleted) EventName() string { return GenerationCompletedEvent }
+
+// GenerationFailed is published when answering a prompt ended with an error.
+type GenerationFailed struct {
+	ChatID     string
+	PromptID   string
+	TokenCount int
+	Error      string
+}
+
+func (GenerationFailed) EventName() string { return GenerationFailedEvent }
+
+// GenerationCancelled is published when answering a prompt was stopped.
+type GenerationCancelled struct {
+	ChatID     string
+	PromptID   string
+	TokenCount int
+}
+
+func (GenerationCancelled) EventName() string { return GenerationCancelledEvent }
+
+// StopRequested is published when a client asks to stop answering a prompt.
+type StopRequested struct {
+	PromptID string
+}
+
+func (StopRequested) EventName() string { return StopRequestedEvent }
+
+// PersonaCreated is published when a persona preset is created.
+type PersonaCreated struct {
+	PersonaID string
+	Name      string
+}
+
+func (PersonaCreated) EventName() string { return PersonaCreatedEvent }
+
+// PersonaUpdated is published when a persona preset is changed.
+type PersonaUpdated struct {
+	PersonaID string
+	Name      string
+}
+
+func (PersonaUpdated) EventName() string { return PersonaUpdatedEvent }
+
+// PersonaDeleted is published when a persona preset is deleted.
+type PersonaDeleted struct {
+	PersonaID string
+}
+
+func (PersonaDeleted) EventName() string { return PersonaDeletedEvent }
@@ -0,0 +1,409 @@
+// Package gateway serves OpenAI-compatible endpoints under /v1, so that
+// clients of the OpenAI API can use the configured engines through this
+// server, optionally keeping every call as a chat.
+package gateway
+
+import (
+	"context"
+	"demo/chat"
+	"demo/events"
+	"demo/lifecycle"
+	"demo/promptprocessing"
+	"demo/pubsub"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+// maxBodySize limits the size of request bodies, which carry whole
+// conversations.
+const maxBodySize = 4 << 20
+
+// Gateway answers OpenAI chat completion requests through the prompt
+// processing service.
+type Gateway struct {
+	processing  *promptprocessing.PromptProcessingService
+	engines     *promptprocessing.EngineRegistry
+	chatService *chat.ChatService
+	lc          *lifecycle.Manager
+	record      bool
+}
+
+// New creates the gateway. If record is true every completion is stored as a
+// chat. Completions are refused once lc begins shutting down.
+func New(processing *promptprocessing.PromptProcessingService, engines *promptprocessing.EngineRegistry, chatService *chat.ChatService, lc *lifecycle.Manager, record bool) *Gateway {
+	return &Gateway{
+		processing:  processing,
+		engines:     engines,
+		chatService: chatService,
+		lc:          lc,
+		record:      record,
+	}
+}
+
+// Handler returns the handler serving the gateway, meant to be mounted at /v1.
+func (g *Gateway) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/models", g.listModels)
+	// Model IDs are engine names such as "ollama/llama3.1:8b"
+	r.Get("/models/*", g.getModel)
+	r.Post("/chat/completions", g.chatCompletions)
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "not_found", "no such endpoint")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "method not allowed")
+	})
+	return r
+}
+
+func (g *Gateway) listModels(w http.ResponseWriter, r *http.Request) {
+	models := []Model{}
+	for _, name := range g.engines.Names() {
+		models = append(models, model(name))
+	}
+	writeJSON(w, http.StatusOK, ModelList{Object: "list", Data: models})
+}
+
+func (g *Gateway) getModel(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "*")
+	if _, err := g.engines.Get(name); err != nil {
+		writeError(w, http.StatusNotFound, "invalid_request_error", "model_not_found", fmt.Sprintf("model %s does not exist", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, model(name))
+}
+
+// model describes the engine registered under name.
+func model(name string) Model {
+	provider, _, _ := strings.Cut(name, "/")
+	return Model{ID: name, Object: "model", OwnedBy: provider}
+}
+
+// resolveModel picks the engine answering a request for model: the engine
+// of that name, else the first whose model it is, else the default engine
+// generating with model instead of its own. An empty engine name stands for
+// the default engine.
+func (g *Gateway) resolveModel(model string) (engineName, modelOverride string) {
+	if model == "" {
+		return "", ""
+	}
+	if _, err := g.engines.Get(model); err == nil {
+		return model, ""
+	}
+	for _, name := range g.engines.Names() {
+		if _, engineModel, _ := strings.Cut(name, "/"); engineModel == model {
+			return name, ""
+		}
+	}
+	return "", model
+}
+
+func (g *Gateway) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	if g.lc.IsShuttingDown() {
+		writeError(w, http.StatusServiceUnavailable, "server_error", "shutting_down", "server is shutting down")
+		return
+	}
+
+	var req ChatCompletionRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid_request", err.Error())
+		return
+	}
+
+	engineName, modelOverride := g.resolveModel(req.Model)
+	settings := req.settings(modelOverride)
+
+	var chatID, promptID string
+	if g.record {
+		var err error
+		chatID, promptID, err = g.recordCall(req, settings)
+		if err != nil {
+			log.Printf("Failed to record completion: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "server_error", "internal_error", "failed to record the completion")
+			return
+		}
+	} else {
+		promptID = uuid.New().String()
+	}
+
+	// Subscribe before generating so that no event is missed
+	ctx := r.Context()
+	eventCh, done := g.chatService.StreamEvents(ctx, chatID, promptID)
+	result := make(chan error, 1)
+	go func() {
+		result <- g.processing.Complete(chatID, promptID, engineName, req.conversation(), generateOptions(settings))
+	}()
+
+	completion := completion{
+		id:      "chatcmpl-" + promptID,
+		created: time.Now().Unix(),
+		model:   req.Model,
+	}
+	var out completionWriter
+	if req.Stream {
+		out = &streamWriter{completion: completion, w: w, includeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage}
+	} else {
+		out = &bufferedWriter{completion: completion, w: w}
+	}
+	g.follow(ctx, chatID, promptID, eventCh, done, result, out)
+}
+
+// recordCall stores the conversation of a call as a new chat: earlier turns
+// as answered prompts, and the trailing user messages as the prompt being
+// answered, whose ID it returns. System messages are not stored.
+func (g *Gateway) recordCall(req ChatCompletionRequest, settings chat.Settings) (chatID, promptID string, err error) {
+	var exchanges [][2]string
+	var pending []string
+	for _, message := range req.Messages {
+		switch messageRoles[message.Role] {
+		case promptprocessing.RoleUser:
+			pending = append(pending, string(message.Content))
+		case promptprocessing.RoleAssistant:
+			exchanges = append(exchanges, [2]string{strings.Join(pending, "\n\n"), string(message.Content)})
+			pending = nil
+		}
+	}
+	promptText := strings.Join(pending, "\n\n")
+
+	chatID, err = g.chatService.CreateChat(chat.NameFromPrompt(promptText), "")
+	if err != nil {
+		return "", "", err
+	}
+	if err := g.chatService.UpdateSettings(chatID, settings); err != nil {
+		return "", "", err
+	}
+	for _, exchange := range exchanges {
+		if err := g.chatService.RecordExchange(chatID, exchange[0], exchange[1]); err != nil {
+			return "", "", err
+		}
+	}
+	prompt, err := g.chatService.RecordPrompt(chatID, promptText)
+	if err != nil {
+		return "", "", err
+	}
+	return chatID, prompt.Id(), nil
+}
+
+// follow writes the events of a generation to out until it ended. If the
+// client goes away first, the generation is stopped. Once shutdown begins the
+// call ends, so that it does not hold up the server; a recorded generation
+// goes on to be stored, while one nobody will read is stopped.
+func (g *Gateway) follow(ctx context.Context, chatID, promptID string, eventCh <-chan pubsub.Event, done <-chan struct{}, result <-chan error, out completionWriter) {
+	var usage Usage
+	for {
+		select {
+		case event := <-eventCh:
+			switch event := event.(type) {
+			case events.GenerationStarted:
+				usage.PromptTokens = event.PromptTokens
+				out.start(event.Model)
+			case events.TokensGenerated:
+				out.token(event.ResponseText)
+			case events.GenerationCompleted:
+				// The engine's own counts replace the estimate of the prompt
+				// and the count of streamed chunks, where it reported them
+				if event.PromptTokens > 0 {
+					usage.PromptTokens = event.PromptTokens
+				}
+				usage.CompletionTokens = event.CompletionTokens
+				if usage.CompletionTokens == 0 {
+					usage.CompletionTokens = event.TokenCount
+				}
+				usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+				finishReason := event.FinishReason
+				if finishReason == "" {
+					finishReason = promptprocessing.FinishStop
+				}
+				out.complete(usage, finishReason)
+				return
+			case events.GenerationFailed:
+				out.fail(http.StatusBadGateway, "server_error", "generation_failed", event.Error)
+				return
+			case events.GenerationCancelled:
+				out.fail(http.StatusServiceUnavailable, "server_error", "generation_cancelled", "generation was cancelled")
+				return
+			}
+		case err := <-result:
+			if errors.Is(err, promptprocessing.ErrShuttingDown) {
+				out.fail(http.StatusServiceUnavailable, "server_error", "shutting_down", "server is shutting down")
+				return
+			}
+			if err != nil {
+				log.Printf("Completion of PromptID=%s failed: %v\n", promptID, err)
+				out.fail(http.StatusInternalServerError, "server_error", "internal_error", "internal server error")
+				return
+			}
+			// The generation ended; its last events are still on their way
+			result = nil
+		case <-done:
+			if ctx.Err() == nil {
+				// Subscription dropped because the client fell behind
+				out.fail(http.StatusInternalServerError, "server_error", "internal_error", "response stream lagged behind")
+			}
+			g.chatService.RequestStop(promptID)
+			return
+		case <-g.lc.ShuttingDown():
+			if chatID == "" {
+				g.chatService.RequestStop(promptID)
+			}
+			out.fail(http.StatusServiceUnavailable, "server_error", "shutting_down", "server is shutting down")
+			return
+		}
+	}
+}
+
+// completion identifies the answer to a call.
+type completion struct {
+	id      string
+	created int64
+	model   string
+}
+
+// completionWriter writes the events of a generation as an OpenAI response.
+type completionWriter interface {
+	start(model string)
+	token(text string)
+	complete(usage Usage, finishReason string)
+	fail(status int, errType, code, message string)
+}
+
+// bufferedWriter writes the answer as a single chat.completion object once
+// it is complete.
+type bufferedWriter struct {
+	completion
+	w    http.ResponseWriter
+	text strings.Builder
+}
+
+func (b *bufferedWriter) start(model string) {
+	b.model = model
+}
+
+func (b *bufferedWriter) token(text string) {
+	b.text.WriteString(text)
+}
+
+func (b *bufferedWriter) complete(usage Usage, finishReason string) {
+	writeJSON(b.w, http.StatusOK, ChatCompletion{
+		ID:      b.id,
+		Object:  "chat.completion",
+		Created: b.created,
+		Model:   b.model,
+		Choices: []Choice{{
+			Message:      Message{Role: "assistant", Content: messageContent(b.text.String())},
+			FinishReason: finishReason,
+		}},
+		Usage: usage,
+	})
+}
+
+func (b *bufferedWriter) fail(status int, errType, code, message string) {
+	writeError(b.w, status, errType, code, message)
+}
+
+// streamWriter writes the answer as server-sent chat.completion.chunk
+// objects while it is generated. Failures before the first chunk are
+// answered with an error status like those of buffered answers.
+type streamWriter struct {
+	completion
+	w            http.ResponseWriter
+	includeUsage bool
+	started      bool
+}
+
+func (s *streamWriter) start(model string) {
+	s.model = model
+
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.Header().Set("Connection", "keep-alive")
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+
+	s.chunk(Delta{Role: "assistant"}, nil)
+}
+
+func (s *streamWriter) token(text string) {
+	s.chunk(Delta{Content: text}, nil)
+}
+
+func (s *streamWriter) complete(usage Usage, finishReason string) {
+	if !s.started {
+		s.start(s.model)
+	}
+
+	s.chunk(Delta{}, &finishReason)
+	if s.includeUsage {
+		s.write(ChatCompletionChunk{
+			ID:      s.id,
+			Object:  "chat.completion.chunk",
+			Created: s.created,
+			Model:   s.model,
+			Choices: []ChunkChoice{},
+			Usage:   &usage,
+		})
+	}
+	s.send("[DONE]")
+}
+
+func (s *streamWriter) fail(status int, errType, code, message string) {
+	if !s.started {
+		writeError(s.w, status, errType, code, message)
+		return
+	}
+	s.write(Error{Error: ErrorDetail{Message: message, Type: errType, Code: code}})
+}
+
+// chunk writes a chunk adding delta to the answer.
+func (s *streamWriter) chunk(delta Delta, finishReason *string) {
+	s.write(ChatCompletionChunk{
+		ID:      s.id,
+		Object:  "chat.completion.chunk",
+		Created: s.created,
+		Model:   s.model,
+		Choices: []ChunkChoice{{Delta: delta, FinishReason: finishReason}},
+	})
+}
+
+// write sends v encoded as JSON in an SSE message.
+func (s *streamWriter) write(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode completion chunk: %v\n", err)
+		return
+	}
+	s.send(string(data))
+}
+
+// send writes an SSE message without event name and flushes it.
+func (s *streamWriter) send(data string) {
+	fmt.Fprintf(s.w, "data: %s\n\n", data)
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes an error in the shape of the OpenAI API.
+func writeError(w http.ResponseWriter, status int, errType, code, message string) {
+	writeJSON(w, status, Error{Error: ErrorDetail{Message: message, Type: errType, Code: code}})
+}
@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"demo/chat"
+	"demo/lifecycle"
+	"demo/persona"
+	"demo/promptprocessing"
+	"demo/pubsub"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkEngine streams fixed chunks of text, then reports how the answer ended.
+type chunkEngine struct {
+	chunks []string
+	end    promptprocessing.Token
+}
+
+func (e *chunkEngine) GenerateTokens(ctx context.Context, id string, messages []promptprocessing.Message, opts promptprocessing.GenerateOptions) (<-chan promptprocessing.Token, error) {
+	tokenChan := make(chan promptprocessing.Token, len(e.chunks)+1)
+	for _, chunk := range e.chunks {
+		tokenChan <- promptprocessing.Token{Text: chunk}
+	}
+	tokenChan <- e.end
+	close(tokenChan)
+	return tokenChan, nil
+}
+
+func (e *chunkEngine) Model() string {
+	return "model"
+}
+
+// newTestGateway serves a gateway answering with engine as "stub/model".
+func newTestGateway(t *testing.T, engine promptprocessing.LLMEngineType) *httptest.Server {
+	t.Helper()
+
+	ps := pubsub.NewPubSub()
+	personas := persona.NewPersonaService(persona.NewPersonaRepository(), ps)
+	chats := chat.NewChatService(chat.NewChatRepository(), ps, personas)
+	chats.Start()
+	engines := promptprocessing.NewEngineRegistry()
+	engines.Register("stub/model", engine)
+	processing := promptprocessing.NewPromptProcessingService(ps, engines, chats, personas)
+	processing.Start()
+
+	ts := httptest.NewServer(New(processing, engines, chats, lifecycle.NewManager(time.Second), false).Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// post sends a chat completion request and returns the response.
+func post(t *testing.T, ts *httptest.Server, body string) *http.Response {
+	t.Helper()
+
+	resp, err := http.Post(ts.URL+"/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /chat/completions: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /chat/completions: status %s", resp.Status)
+	}
+	return resp
+}
+
+func TestChatCompletionReportsEngineFinish(t *testing.T) {
+	tests := []struct {
+		name       string
+		end        promptprocessing.Token
+		wantReason string
+		wantUsage  Usage
+	}{
+		{
+			name:       "cut off",
+			end:        promptprocessing.Token{FinishReason: promptprocessing.FinishLength, PromptTokens: 9, CompletionTokens: 6},
+			wantReason: "length",
+			wantUsage:  Usage{PromptTokens: 9, CompletionTokens: 6, TotalTokens: 15},
+		},
+		{
+			name:       "ended by the model",
+			end:        promptprocessing.Token{FinishReason: promptprocessing.FinishStop, PromptTokens: 9, CompletionTokens: 6},
+			wantReason: "stop",
+			wantUsage:  Usage{PromptTokens: 9, CompletionTokens: 6, TotalTokens: 15},
+		},
+		{
+			// The prompt is estimated, and the streamed chunks stand in for the answer
+			name:       "nothing reported",
+			wantReason: "stop",
+			wantUsage:  Usage{CompletionTokens: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Chunks of several words, as engines commonly stream them
+			engine := &chunkEngine{chunks: []string{"one two three ", "four five six"}, end: tt.end}
+			ts := newTestGateway(t, engine)
+
+			resp := post(t, ts, `{"model": "stub/model", "messages": [{"role": "user", "content": "Count to six"}], "max_tokens": 6}`)
+			var completion struct {
+				Choices []struct {
+					Message struct {
+						Content string `json:"content"`
+					} `json:"message"`
+					FinishReason string `json:"finish_reason"`
+				} `json:"choices"`
+				Usage Usage `json:"usage"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+				t.Fatalf("decoding completion: %v", err)
+			}
+
+			if len(completion.Choices) != 1 {
+				t.Fatalf("got %d choices, want 1", len(completion.Choices))
+			}
+			choice := completion.Choices[0]
+			if choice.Message.Content != "one two three four five six" {
+				t.Errorf("content is %q", choice.Message.Content)
+			}
+			if choice.FinishReason != tt.wantReason {
+				t.Errorf("finish reason is %q, want %q", choice.FinishReason, tt.wantReason)
+			}
+			usage := completion.Usage
+			if tt.end.PromptTokens == 0 {
+				// Only check the estimate is there
+				if usage.PromptTokens == 0 || usage.TotalTokens != usage.PromptTokens+usage.CompletionTokens {
+					t.Errorf("usage is %+v, want an estimated prompt", usage)
+				}
+				usage.PromptTokens, usage.TotalTokens = 0, 0
+			}
+			if usage != tt.wantUsage {
+				t.Errorf("usage is %+v, want %+v", usage, tt.wantUsage)
+			}
+		})
+	}
+}
+
+func TestStreamedChatCompletionReportsEngineFinish(t *testing.T) {
+	engine := &chunkEngine{
+		chunks: []string{"one two three ", "four five six"},
+		end:    promptprocessing.Token{FinishReason: promptprocessing.FinishLength, PromptTokens: 9, CompletionTokens: 6},
+	}
+	ts := newTestGateway(t, engine)
+
+	resp := post(t, ts, `{"model": "stub/model", "messages": [{"role": "user", "content": "Count to six"}], "max_tokens": 6, "stream": true, "stream_options": {"include_usage": true}}`)
+
+	var text strings.Builder
+	var reasons []string
+	var usage *Usage
+	done := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decoding chunk %s: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			text.WriteString(choice.Delta.Content)
+			if choice.FinishReason != nil {
+				reasons = append(reasons, *choice.FinishReason)
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+
+	if !done {
+		t.Fatalf("stream ended without [DONE]: %v", scanner.Err())
+	}
+	if text.String() != "one two three four five six" {
+		t.Errorf("streamed %q", text.String())
+	}
+	if len(reasons) != 1 || reasons[0] != "length" {
+		t.Errorf("finish reasons are %v, want [length]", reasons)
+	}
+	if want := (Usage{PromptTokens: 9, CompletionTokens: 6, TotalTokens: 15}); usage == nil || *usage != want {
+		t.Errorf("usage is %+v, want %+v", usage, want)
+	}
+}
@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"bytes"
+	"demo/chat"
+	"demo/promptprocessing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChatCompletionRequest is the body of POST /v1/chat/completions. Fields of
+// the OpenAI API that the engines have no use for are ignored.
+type ChatCompletionRequest struct {
+	Model               string         `json:"model"`
+	Messages            []Message      `json:"messages"`
+	Stream              bool           `json:"stream"`
+	StreamOptions       *StreamOptions `json:"stream_options"`
+	Temperature         *float64       `json:"temperature"`
+	TopP                *float64       `json:"top_p"`
+	MaxTokens           *int           `json:"max_tokens"`
+	MaxCompletionTokens *int           `json:"max_completion_tokens"`
+	Stop                stopList       `json:"stop"`
+	Seed                *int           `json:"seed"`
+	N                   *int           `json:"n"`
+}
+
+// StreamOptions configures a streamed completion.
+type StreamOptions struct {
+	// IncludeUsage sends a last chunk with the token usage of the call.
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Message is a message of the conversation to complete.
+type Message struct {
+	Role    string         `json:"role"`
+	Content messageContent `json:"content"`
+}
+
+// messageContent is the text of a message, given either as a string or as
+// an array of content parts of which only text parts are supported.
+type messageContent string
+
+func (c *messageContent) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*c = ""
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = messageContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or an array of content parts")
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("content parts of type %q are not supported", part.Type)
+		}
+		texts = append(texts, part.Text)
+	}
+	*c = messageContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+// stopList holds the stop sequences, given either as a string or an array.
+type stopList []string
+
+func (s *stopList) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*s = nil
+		return nil
+	}
+
+	var stop string
+	if err := json.Unmarshal(data, &stop); err == nil {
+		*s = stopList{stop}
+		return nil
+	}
+
+	var stops []string
+	if err := json.Unmarshal(data, &stops); err != nil {
+		return errors.New("stop must be a string or an array of strings")
+	}
+	*s = stops
+	return nil
+}
+
+// validate checks that the request can be answered by the engines.
+func (r ChatCompletionRequest) validate() error {
+	if len(r.Messages) == 0 {
+		return errors.New("messages must not be empty")
+	}
+	for i, message := range r.Messages {
+		if _, ok := messageRoles[message.Role]; !ok {
+			return fmt.Errorf("messages[%d]: unsupported role %q", i, message.Role)
+		}
+	}
+	if r.Messages[len(r.Messages)-1].Role != "user" {
+		return errors.New("the last message must be from the user")
+	}
+	if r.N != nil && *r.N != 1 {
+		return errors.New("only n=1 is supported")
+	}
+	return r.settings("").Validate()
+}
+
+// messageRoles maps the roles of the OpenAI API to those of the engines.
+var messageRoles = map[string]promptprocessing.Role{
+	"system":    promptprocessing.RoleSystem,
+	"developer": promptprocessing.RoleSystem,
+	"user":      promptprocessing.RoleUser,
+	"assistant": promptprocessing.RoleAssistant,
+}
+
+// settings returns the generation settings of the request. A non-empty
+// model replaces the model of the engine answering it.
+func (r ChatCompletionRequest) settings(model string) chat.Settings {
+	maxTokens := r.MaxCompletionTokens
+	if maxTokens == nil {
+		maxTokens = r.MaxTokens
+	}
+	return chat.Settings{
+		Model:       model,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		MaxTokens:   maxTokens,
+		Stop:        r.Stop,
+		Seed:        r.Seed,
+	}
+}
+
+// conversation returns the messages of the request as the engines take them.
+func (r ChatCompletionRequest) conversation() []promptprocessing.Message {
+	messages := make([]promptprocessing.Message, len(r.Messages))
+	for i, message := range r.Messages {
+		messages[i] = promptprocessing.Message{
+			Role:    messageRoles[message.Role],
+			Content: string(message.Content),
+		}
+	}
+	return messages
+}
+
+// generateOptions converts generation settings to engine options.
+func generateOptions(settings chat.Settings) promptprocessing.GenerateOptions {
+	return promptprocessing.GenerateOptions{
+		Model:       settings.Model,
+		Temperature: settings.Temperature,
+		TopP:        settings.TopP,
+		MaxTokens:   settings.MaxTokens,
+		Stop:        settings.Stop,
+		Seed:        settings.Seed,
+	}
+}
+
+// ChatCompletion is the answer to a request that is not streamed.
+type ChatCompletion struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Choices []Choice `json:"choices"`
+	Usage   Usage    `json:"usage"`
+}
+
+// Choice is a completion of the conversation.
+type Choice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+// ChatCompletionChunk is a part of a streamed answer.
+type ChatCompletionChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage,omitempty"`
+}
+
+// ChunkChoice is the part of a completion that a chunk adds.
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Delta   `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// Delta is the text that a chunk appends to the answer.
+type Delta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// Usage counts the tokens of a call. Prompt tokens count the conversation
+// the engine actually received, after older messages were dropped to fit
+// its context window.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Model is a model that completions can be requested from.
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ModelList is the body of GET /v1/models.
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// Error is the body of every error response.
+type Error struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes what went wrong.
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code,omitempty"`
+}
@@ -7,10 +7,13 @@ require github.com/google/uuid v1.6.0
 require (
 	github.com/a-h/templ v0.3.819
 	github.com/go-chi/chi v1.5.5
+	github.com/pkoukk/tiktoken-go v0.1.6
 	github.com/tmc/langchaingo v0.1.12
+	go.etcd.io/bbolt v1.3.11
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/dlclark/regexp2 v1.10.0 // indirect
-	github.com/pkoukk/tiktoken-go v0.1.6 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
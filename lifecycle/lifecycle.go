@@ -0,0 +1,111 @@
+// Package lifecycle coordinates the orderly shutdown of the application.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// hook is a named step of the shutdown sequence.
+type hook struct {
+	name    string
+	fn      func(ctx context.Context) error
+	timeout time.Duration // deadline of the step's own, or 0 to share the sequence's
+}
+
+// Manager runs the registered shutdown steps in order once shutdown begins.
+type Manager struct {
+	timeout      time.Duration
+	shuttingDown chan struct{}
+	once         sync.Once
+
+	mu    sync.Mutex
+	hooks []hook
+}
+
+// NewManager creates a Manager that gives the shutdown sequence up to timeout
+// to complete, apart from the steps registered with a timeout of their own.
+func NewManager(timeout time.Duration) *Manager {
+	return &Manager{
+		timeout:      timeout,
+		shuttingDown: make(chan struct{}),
+	}
+}
+
+// OnShutdown registers a step of the shutdown sequence. Steps run in the
+// order they were registered and share the deadline of the sequence.
+func (m *Manager) OnShutdown(name string, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hooks = append(m.hooks, hook{name: name, fn: fn})
+}
+
+// OnShutdownWithTimeout registers a step of the shutdown sequence that is
+// given timeout from when it starts, whether or not the deadline of the
+// sequence has passed. It suits steps that persist what earlier steps left
+// behind, which must not be cut short because those were slow.
+func (m *Manager) OnShutdownWithTimeout(name string, timeout time.Duration, fn func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hooks = append(m.hooks, hook{name: name, fn: fn, timeout: timeout})
+}
+
+// ShuttingDown returns a channel that is closed when shutdown begins.
+func (m *Manager) ShuttingDown() <-chan struct{} {
+	return m.shuttingDown
+}
+
+// IsShuttingDown reports whether shutdown has begun.
+func (m *Manager) IsShuttingDown() bool {
+	select {
+	case <-m.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown closes the ShuttingDown channel and runs every registered step.
+// A failing step does not prevent the later ones from running; their errors
+// are returned together, and steps sharing the deadline of the sequence that
+// start after it receive an expired context. Only the first call runs the steps.
+func (m *Manager) Shutdown() error {
+	var err error
+	m.once.Do(func() {
+		close(m.shuttingDown)
+
+		m.mu.Lock()
+		hooks := append([]hook(nil), m.hooks...)
+		m.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+
+		var errs []error
+		for _, h := range hooks {
+			log.Printf("Shutdown: %s\n", h.name)
+			if hookErr := h.run(ctx); hookErr != nil {
+				log.Printf("Shutdown: %s failed: %v\n", h.name, hookErr)
+				errs = append(errs, fmt.Errorf("%s: %w", h.name, hookErr))
+			}
+		}
+		err = errors.Join(errs...)
+	})
+	return err
+}
+
+// run runs the step with the deadline of the sequence, or its own.
+func (h hook) run(ctx context.Context) error {
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+	}
+	return h.fn(ctx)
+}
@@ -0,0 +1,37 @@
+package lifecycle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStepWithOwnTimeoutOutlivesSharedDeadline(t *testing.T) {
+	m := NewManager(50 * time.Millisecond)
+	m.OnShutdown("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	var sharedErr, ownErr error
+	m.OnShutdown("shared", func(ctx context.Context) error {
+		sharedErr = ctx.Err()
+		return nil
+	})
+	m.OnShutdownWithTimeout("own", time.Second, func(ctx context.Context) error {
+		ownErr = ctx.Err()
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) < 500*time.Millisecond {
+			t.Errorf("step has deadline %v, want about a second from when it started", deadline)
+		}
+		return nil
+	})
+
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if sharedErr == nil {
+		t.Error("step sharing the deadline got a live context after it passed")
+	}
+	if ownErr != nil {
+		t.Errorf("step with its own timeout got an expired context: %v", ownErr)
+	}
+}
@@ -0,0 +1,157 @@
+package persona
+
+import (
+	"demo/chat"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// personaRecord is the stored form of a Persona.
+type personaRecord struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	SystemPrompt string        `json:"systemPrompt"`
+	Settings     chat.Settings `json:"settings"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	UpdatedAt    time.Time     `json:"updatedAt"`
+}
+
+func toPersonaRecord(persona Persona) personaRecord {
+	return personaRecord{
+		ID:           persona.id,
+		Name:         persona.name,
+		SystemPrompt: persona.systemPrompt,
+		Settings:     persona.settings,
+		CreatedAt:    persona.createdAt,
+		UpdatedAt:    persona.updatedAt,
+	}
+}
+
+func fromPersonaRecord(record personaRecord) Persona {
+	return Persona{
+		id:           record.ID,
+		name:         record.Name,
+		systemPrompt: record.SystemPrompt,
+		settings:     record.Settings,
+		createdAt:    record.CreatedAt,
+		updatedAt:    record.UpdatedAt,
+	}
+}
+
+// BoltRepository is a Repository that persists personas in the bbolt
+// database of the chats, see chat.BoltRepository.
+type BoltRepository struct {
+	db *bolt.DB
+}
+
+// NewBoltRepository stores personas in db, which chat.NewBoltRepository
+// opened and migrated. Closing the chat repository closes it.
+func NewBoltRepository(db *bolt.DB) *BoltRepository {
+	return &BoltRepository{db: db}
+}
+
+// getPersona loads a persona inside a transaction.
+func getPersona(tx *bolt.Tx, personaId string) (Persona, error) {
+	data := tx.Bucket(chat.PersonasBucket).Get([]byte(personaId))
+	if data == nil {
+		return Persona{}, ErrPersonaNotFound
+	}
+
+	var record personaRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return Persona{}, fmt.Errorf("decoding persona %s: %w", personaId, err)
+	}
+	return fromPersonaRecord(record), nil
+}
+
+// putPersona stores a persona inside a transaction.
+func putPersona(tx *bolt.Tx, persona Persona) error {
+	data, err := json.Marshal(toPersonaRecord(persona))
+	if err != nil {
+		return fmt.Errorf("encoding persona %s: %w", persona.id, err)
+	}
+	return tx.Bucket(chat.PersonasBucket).Put([]byte(persona.id), data)
+}
+
+// AddPersona adds a new persona to the repository and returns its ID.
+func (r *BoltRepository) AddPersona(name, systemPrompt string, settings chat.Settings) (string, error) {
+	persona := Persona{
+		id:           uuid.New().String(),
+		name:         name,
+		systemPrompt: systemPrompt,
+		settings:     settings,
+		createdAt:    time.Now(),
+		updatedAt:    time.Now(),
+	}
+
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return putPersona(tx, persona)
+	})
+	if err != nil {
+		return "", err
+	}
+	return persona.id, nil
+}
+
+// GetPersona retrieves a persona by its ID.
+func (r *BoltRepository) GetPersona(personaId string) (Persona, error) {
+	var persona Persona
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		persona, err = getPersona(tx, personaId)
+		return err
+	})
+	return persona, err
+}
+
+// ListPersonas returns all personas ordered by name.
+func (r *BoltRepository) ListPersonas() ([]Persona, error) {
+	var personas []Persona
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(chat.PersonasBucket).ForEach(func(k, v []byte) error {
+			var record personaRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("decoding persona %s: %w", k, err)
+			}
+			personas = append(personas, fromPersonaRecord(record))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortPersonas(personas)
+	return personas, nil
+}
+
+// UpdatePersona replaces the preset of an existing persona.
+func (r *BoltRepository) UpdatePersona(personaId, name, systemPrompt string, settings chat.Settings) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		persona, err := getPersona(tx, personaId)
+		if err != nil {
+			return err
+		}
+
+		persona.name = name
+		persona.systemPrompt = systemPrompt
+		persona.settings = settings
+		persona.updatedAt = time.Now()
+		return putPersona(tx, persona)
+	})
+}
+
+// DeletePersona removes a persona from the repository.
+func (r *BoltRepository) DeletePersona(personaId string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(chat.PersonasBucket)
+		if bucket.Get([]byte(personaId)) == nil {
+			return ErrPersonaNotFound
+		}
+		return bucket.Delete([]byte(personaId))
+	})
+}
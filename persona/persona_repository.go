@@ -0,0 +1,149 @@
+package persona
+
+import (
+	"demo/chat"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Persona is a reusable preset applied to the chats created with it.
+type Persona struct {
+	id           string
+	name         string
+	systemPrompt string
+	settings     chat.Settings
+	createdAt    time.Time
+	updatedAt    time.Time
+}
+
+func (p Persona) Id() string {
+	return p.id
+}
+
+func (p Persona) Name() string {
+	return p.name
+}
+
+func (p Persona) SystemPrompt() string {
+	return p.systemPrompt
+}
+
+// Settings returns the default model and generation parameters of the persona.
+func (p Persona) Settings() chat.Settings {
+	return p.settings
+}
+
+var ErrPersonaNotFound = errors.New("persona not found")
+
+// Repository manages the storage and retrieval of personas.
+type Repository interface {
+	// AddPersona adds a new persona and returns its ID.
+	AddPersona(name, systemPrompt string, settings chat.Settings) (string, error)
+	// GetPersona retrieves a persona by its ID.
+	GetPersona(personaId string) (Persona, error)
+	// ListPersonas returns all personas ordered by name.
+	ListPersonas() ([]Persona, error)
+	// UpdatePersona replaces the preset of an existing persona.
+	UpdatePersona(personaId, name, systemPrompt string, settings chat.Settings) error
+	// DeletePersona removes a persona.
+	DeletePersona(personaId string) error
+}
+
+// PersonaRepository is an in-memory Repository. Its contents are lost on restart.
+type PersonaRepository struct {
+	personas map[string]*Persona
+	mu       sync.Mutex
+}
+
+// NewPersonaRepository creates a new PersonaRepository.
+func NewPersonaRepository() *PersonaRepository {
+	return &PersonaRepository{
+		personas: make(map[string]*Persona),
+	}
+}
+
+// AddPersona adds a new persona to the repository and returns its ID.
+func (r *PersonaRepository) AddPersona(name, systemPrompt string, settings chat.Settings) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	persona := &Persona{
+		id:           uuid.New().String(),
+		name:         name,
+		systemPrompt: systemPrompt,
+		settings:     settings,
+		createdAt:    time.Now(),
+		updatedAt:    time.Now(),
+	}
+
+	r.personas[persona.id] = persona
+	return persona.id, nil
+}
+
+// GetPersona retrieves a copy of a persona by its ID.
+func (r *PersonaRepository) GetPersona(personaId string) (Persona, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	persona, exists := r.personas[personaId]
+	if !exists {
+		return Persona{}, ErrPersonaNotFound
+	}
+
+	return *persona, nil
+}
+
+// ListPersonas returns copies of all personas ordered by name.
+func (r *PersonaRepository) ListPersonas() ([]Persona, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	personas := make([]Persona, 0, len(r.personas))
+	for _, persona := range r.personas {
+		personas = append(personas, *persona)
+	}
+	sortPersonas(personas)
+	return personas, nil
+}
+
+// sortPersonas orders personas by name.
+func sortPersonas(personas []Persona) {
+	sort.Slice(personas, func(i, j int) bool {
+		return personas[i].name < personas[j].name
+	})
+}
+
+// UpdatePersona replaces the preset of an existing persona.
+func (r *PersonaRepository) UpdatePersona(personaId, name, systemPrompt string, settings chat.Settings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	persona, exists := r.personas[personaId]
+	if !exists {
+		return ErrPersonaNotFound
+	}
+
+	persona.name = name
+	persona.systemPrompt = systemPrompt
+	persona.settings = settings
+	persona.updatedAt = time.Now()
+	return nil
+}
+
+// DeletePersona removes a persona from the repository.
+func (r *PersonaRepository) DeletePersona(personaId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, exists := r.personas[personaId]
+	if !exists {
+		return ErrPersonaNotFound
+	}
+
+	delete(r.personas, personaId)
+	return nil
+}
@@ -0,0 +1,105 @@
+package persona
+
+import (
+	"demo/chat"
+	"demo/events"
+	"demo/pubsub"
+	"errors"
+	"strings"
+)
+
+var ErrNameRequired = errors.New("persona name is required")
+
+// PersonaService manages persona presets.
+type PersonaService struct {
+	repo   Repository
+	pubSub *pubsub.PubSub
+}
+
+// NewPersonaService creates a new PersonaService with the given repository and PubSub system.
+func NewPersonaService(repo Repository, pubSub *pubsub.PubSub) *PersonaService {
+	return &PersonaService{
+		repo:   repo,
+		pubSub: pubSub,
+	}
+}
+
+// CreatePersona validates and stores a new persona and publishes a "PersonaCreated" event.
+func (s *PersonaService) CreatePersona(name, systemPrompt string, settings chat.Settings) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrNameRequired
+	}
+	if err := settings.Validate(); err != nil {
+		return "", err
+	}
+
+	personaID, err := s.repo.AddPersona(name, systemPrompt, settings)
+	if err != nil {
+		return "", err
+	}
+	pubsub.Publish(s.pubSub, events.PersonaCreated{
+		PersonaID: personaID,
+		Name:      name,
+	})
+
+	return personaID, nil
+}
+
+// GetPersona retrieves a persona by its ID.
+func (s *PersonaService) GetPersona(personaID string) (Persona, error) {
+	return s.repo.GetPersona(personaID)
+}
+
+// ListPersonas returns all personas ordered by name.
+func (s *PersonaService) ListPersonas() ([]Persona, error) {
+	return s.repo.ListPersonas()
+}
+
+// UpdatePersona validates and replaces a persona and publishes a "PersonaUpdated" event.
+// Chats created earlier keep the settings they were created with.
+func (s *PersonaService) UpdatePersona(personaID, name, systemPrompt string, settings chat.Settings) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrNameRequired
+	}
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	err := s.repo.UpdatePersona(personaID, name, systemPrompt, settings)
+	if err != nil {
+		return err
+	}
+
+	pubsub.Publish(s.pubSub, events.PersonaUpdated{
+		PersonaID: personaID,
+		Name:      name,
+	})
+
+	return nil
+}
+
+// DeletePersona deletes a persona and publishes a "PersonaDeleted" event.
+func (s *PersonaService) DeletePersona(personaID string) error {
+	err := s.repo.DeletePersona(personaID)
+	if err != nil {
+		return err
+	}
+
+	pubsub.Publish(s.pubSub, events.PersonaDeleted{
+		PersonaID: personaID,
+	})
+
+	return nil
+}
+
+// PersonaSettings returns the default settings of a persona, letting
+// ChatService apply them to the chats created with it.
+func (s *PersonaService) PersonaSettings(personaID string) (chat.Settings, error) {
+	persona, err := s.repo.GetPersona(personaID)
+	if err != nil {
+		return chat.Settings{}, err
+	}
+	return persona.settings, nil
+}
@@ -0,0 +1,115 @@
+package promptprocessing
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// HealthChecker is implemented by engines that can tell whether their backend is reachable.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// Prober is implemented by engines that can verify their model is available
+// before the first prompt, optionally pulling it onto the server.
+type Prober interface {
+	Probe(ctx context.Context, pull bool) error
+}
+
+// EngineHealth is the outcome of the last health check of an engine.
+type EngineHealth struct {
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// Probe verifies that the named engine can serve its model. Engines that
+// cannot be probed pass.
+func (r *EngineRegistry) Probe(ctx context.Context, name string, pull bool) error {
+	engine, err := r.Get(name)
+	if err != nil {
+		return err
+	}
+	prober, ok := engine.(Prober)
+	if !ok {
+		return nil
+	}
+	return prober.Probe(ctx, pull)
+}
+
+// CheckHealth checks every engine that supports it and records the outcome.
+func (r *EngineRegistry) CheckHealth(ctx context.Context) map[string]EngineHealth {
+	r.mu.RLock()
+	checkers := make(map[string]HealthChecker)
+	for name, engine := range r.engines {
+		if checker, ok := engine.(HealthChecker); ok {
+			checkers[name] = checker
+		}
+	}
+	r.mu.RUnlock()
+
+	results := make(map[string]EngineHealth, len(checkers))
+	for name, checker := range checkers {
+		health := EngineHealth{Healthy: true, CheckedAt: time.Now()}
+		if err := checker.CheckHealth(ctx); err != nil {
+			health = EngineHealth{Error: err.Error(), CheckedAt: time.Now()}
+		}
+		results[name] = health
+	}
+
+	r.mu.Lock()
+	for name, health := range results {
+		if previous, checked := r.health[name]; checked && previous.Healthy != health.Healthy {
+			if health.Healthy {
+				log.Printf("Engine %s is healthy again", name)
+			} else {
+				log.Printf("Engine %s became unhealthy: %s", name, health.Error)
+			}
+		}
+		r.health[name] = health
+	}
+	r.mu.Unlock()
+
+	return results
+}
+
+// Health returns the outcome of the last health check of each engine.
+func (r *EngineRegistry) Health() map[string]EngineHealth {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	health := make(map[string]EngineHealth, len(r.health))
+	for name, h := range r.health {
+		health[name] = h
+	}
+	return health
+}
+
+// Reachable reports whether the named engine passed its last health check.
+// Engines that were never checked are assumed to be reachable.
+func (r *EngineRegistry) Reachable(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	health, checked := r.health[name]
+	return !checked || health.Healthy
+}
+
+// MonitorHealth checks the engines every interval until ctx is done.
+func (r *EngineRegistry) MonitorHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		r.CheckHealth(checkCtx)
+		cancel()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package promptprocessing
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrEngineNotFound = errors.New("engine not found")
+
+// EngineConfig describes an engine to create from configuration.
+type EngineConfig struct {
+	Provider string
+	Model    string
+	URL      string
+	APIKey   string
+	// Options holds provider-specific settings.
+	Options map[string]string
+}
+
+// Name returns the registry key of the engine, "provider/model".
+func (c EngineConfig) Name() string {
+	return c.Provider + "/" + c.Model
+}
+
+// EngineFactory creates an engine from its configuration.
+type EngineFactory func(cfg EngineConfig) (LLMEngineType, error)
+
+// providers maps provider names to the factory creating their engines.
+var providers = map[string]EngineFactory{
+	"ollama": func(cfg EngineConfig) (LLMEngineType, error) {
+		return NewOllamaEngine(cfg.Model, cfg.URL), nil
+	},
+	"openai": func(cfg EngineConfig) (LLMEngineType, error) {
+		if cfg.URL == "" {
+			return nil, errors.New("openai provider requires a server URL")
+		}
+		return NewOpenAIEngine(cfg.Model, cfg.URL, cfg.APIKey), nil
+	},
+	"fake": func(cfg EngineConfig) (LLMEngineType, error) {
+		return newFakeEngineFromConfig(cfg)
+	},
+}
+
+// Providers returns the names of the supported providers.
+func Providers() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EngineRegistry holds the available LLM engines keyed by "provider/model".
+type EngineRegistry struct {
+	mu          sync.RWMutex
+	engines     map[string]LLMEngineType
+	health      map[string]EngineHealth
+	defaultName string
+}
+
+// NewEngineRegistry creates an empty EngineRegistry.
+func NewEngineRegistry() *EngineRegistry {
+	return &EngineRegistry{
+		engines: make(map[string]LLMEngineType),
+		health:  make(map[string]EngineHealth),
+	}
+}
+
+// Register adds an engine under the given name. The first engine registered
+// becomes the default.
+func (r *EngineRegistry) Register(name string, engine LLMEngineType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.engines[name] = engine
+	if r.defaultName == "" {
+		r.defaultName = name
+	}
+}
+
+// Create builds an engine from its configuration and registers it.
+func (r *EngineRegistry) Create(cfg EngineConfig) (LLMEngineType, error) {
+	factory, exists := providers[cfg.Provider]
+	if !exists {
+		return nil, fmt.Errorf("unknown engine provider %q", cfg.Provider)
+	}
+	if cfg.Model == "" {
+		return nil, fmt.Errorf("engine %q requires a model", cfg.Provider)
+	}
+
+	engine, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Register(cfg.Name(), engine)
+	return engine, nil
+}
+
+// Get returns the engine registered under name.
+func (r *EngineRegistry) Get(name string) (LLMEngineType, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	engine, exists := r.engines[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrEngineNotFound, name)
+	}
+	return engine, nil
+}
+
+// SetDefault makes the engine registered under name the default.
+func (r *EngineRegistry) SetDefault(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.engines[name]; !exists {
+		return fmt.Errorf("%w: %s", ErrEngineNotFound, name)
+	}
+	r.defaultName = name
+	return nil
+}
+
+// Default returns the default engine and its name.
+func (r *EngineRegistry) Default() (string, LLMEngineType, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	engine, exists := r.engines[r.defaultName]
+	if !exists {
+		return "", nil, ErrEngineNotFound
+	}
+	return r.defaultName, engine, nil
+}
+
+// Names returns the names of the registered engines.
+func (r *EngineRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.engines))
+	for name := range r.engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,176 @@
+package promptprocessing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeEngine implements the LLMEngineType interface without a model server.
+// It streams a scripted answer, or echoes the latest user message, word by
+// word so the app can be run and tested offline.
+type FakeEngine struct {
+	model string
+
+	// Script is streamed as the answer to every request. When empty the
+	// latest user message is echoed back.
+	Script string
+	// Delay is waited before every token.
+	Delay time.Duration
+	// Err, if set, is returned by GenerateTokens instead of starting a generation.
+	Err error
+	// FailAfter, if positive, ends every generation with FailErr after that many tokens.
+	FailAfter int
+	FailErr   error
+	// FailCalls is how many calls to GenerateTokens fail with
+	// ErrEngineUnavailable before the engine starts answering.
+	FailCalls int
+
+	mu    sync.Mutex
+	calls int
+}
+
+// NewFakeEngine creates a FakeEngine that echoes prompts without delay.
+func NewFakeEngine(model string) *FakeEngine {
+	return &FakeEngine{
+		model:   model,
+		FailErr: errors.New("fake engine failure"),
+	}
+}
+
+// newFakeEngineFromConfig creates a FakeEngine from the provider options
+// "script", "delay", "error", "fail_after", "fail_error" and "fail_calls".
+func newFakeEngineFromConfig(cfg EngineConfig) (*FakeEngine, error) {
+	engine := NewFakeEngine(cfg.Model)
+	engine.Script = cfg.Options["script"]
+
+	if delay, ok := cfg.Options["delay"]; ok {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fake engine delay: %w", err)
+		}
+		engine.Delay = d
+	}
+	if msg, ok := cfg.Options["error"]; ok {
+		engine.Err = errors.New(msg)
+	}
+	if failAfter, ok := cfg.Options["fail_after"]; ok {
+		n, err := strconv.Atoi(failAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fake engine fail_after: %w", err)
+		}
+		engine.FailAfter = n
+	}
+	if msg, ok := cfg.Options["fail_error"]; ok {
+		engine.FailErr = errors.New(msg)
+	}
+	if failCalls, ok := cfg.Options["fail_calls"]; ok {
+		n, err := strconv.Atoi(failCalls)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fake engine fail_calls: %w", err)
+		}
+		engine.FailCalls = n
+	}
+
+	return engine, nil
+}
+
+func (f *FakeEngine) GenerateTokens(ctx context.Context, id string, messages []Message, opts GenerateOptions) (<-chan Token, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	f.mu.Lock()
+	f.calls++
+	calls := f.calls
+	f.mu.Unlock()
+	if calls <= f.FailCalls {
+		return nil, fmt.Errorf("%w: fake engine call %d of %d failing", ErrEngineUnavailable, calls, f.FailCalls)
+	}
+
+	tokenChan := make(chan Token, 100)
+
+	go func() {
+		defer close(tokenChan)
+
+		// Words count as tokens, as far as the fake engine is concerned
+		end := Token{FinishReason: FinishStop}
+		for _, message := range messages {
+			end.PromptTokens += len(splitTokens(message.Content))
+		}
+
+		for i, token := range splitTokens(f.answer(messages)) {
+			if opts.MaxTokens != nil && i == *opts.MaxTokens {
+				end.FinishReason = FinishLength
+				break
+			}
+			if f.FailAfter > 0 && i == f.FailAfter {
+				tokenChan <- Token{Err: f.FailErr}
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				tokenChan <- Token{Err: ctx.Err()}
+				return
+			case <-time.After(f.Delay):
+			}
+
+			tokenChan <- Token{Text: token}
+			end.CompletionTokens++
+		}
+		tokenChan <- end
+	}()
+
+	return tokenChan, nil
+}
+
+// answer returns the text to stream for a conversation.
+func (f *FakeEngine) answer(messages []Message) string {
+	if f.Script != "" {
+		return f.Script
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == RoleUser {
+			return "You said: " + messages[i].Content
+		}
+	}
+	return "You said nothing."
+}
+
+// splitTokens splits text into words, keeping the whitespace that follows
+// each one so the tokens concatenate back to the original text.
+func splitTokens(text string) []string {
+	var tokens []string
+	for len(text) > 0 {
+		end := strings.IndexAny(text, " \n\t")
+		if end < 0 {
+			tokens = append(tokens, text)
+			break
+		}
+		for end < len(text) && strings.ContainsRune(" \n\t", rune(text[end])) {
+			end++
+		}
+		tokens = append(tokens, text[:end])
+		text = text[end:]
+	}
+	return tokens
+}
+
+func (f *FakeEngine) Model() string {
+	return f.model
+}
+
+// CheckHealth fails with Err, if set.
+func (f *FakeEngine) CheckHealth(ctx context.Context) error {
+	return f.Err
+}
+
+// Probe fails with Err, if set. There is no model to pull.
+func (f *FakeEngine) Probe(ctx context.Context, pull bool) error {
+	return f.Err
+}
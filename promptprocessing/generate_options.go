@@ -0,0 +1,58 @@
+package promptprocessing
+
+import "demo/chat"
+
+// defaultTemperature is used when a request leaves the temperature unset.
+const defaultTemperature = 0.8
+
+// GenerateOptions are the per-request generation parameters. Nil or empty
+// fields use the engine defaults.
+type GenerateOptions struct {
+	Model         string
+	Temperature   *float64
+	TopP          *float64
+	TopK          *int
+	MaxTokens     *int
+	Stop          []string
+	Seed          *int
+	RepeatPenalty *float64
+}
+
+// optionsFromSettings converts the settings of a chat to engine options.
+func optionsFromSettings(settings chat.Settings) GenerateOptions {
+	return GenerateOptions{
+		Model:         settings.Model,
+		Temperature:   settings.Temperature,
+		TopP:          settings.TopP,
+		TopK:          settings.TopK,
+		MaxTokens:     settings.MaxTokens,
+		Stop:          settings.Stop,
+		Seed:          settings.Seed,
+		RepeatPenalty: settings.RepeatPenalty,
+	}
+}
+
+// model returns the requested model, or fallback when none was requested.
+func (o GenerateOptions) model(fallback string) string {
+	if o.Model != "" {
+		return o.Model
+	}
+	return fallback
+}
+
+// temperature returns the requested temperature or the default one.
+func (o GenerateOptions) temperature() float64 {
+	if o.Temperature != nil {
+		return *o.Temperature
+	}
+	return defaultTemperature
+}
+
+// answerReserve returns how many tokens of the context window to keep free
+// for the reply: the requested maximum, or DefaultAnswerReserve.
+func (o GenerateOptions) answerReserve() int {
+	if o.MaxTokens != nil {
+		return *o.MaxTokens
+	}
+	return DefaultAnswerReserve
+}
@@ -0,0 +1,92 @@
+package promptprocessing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrFirstTokenTimeout is reported for an attempt that streamed no token
+	// within GenerationPolicy.FirstTokenTimeout.
+	ErrFirstTokenTimeout = errors.New("timed out waiting for the first token")
+	// ErrEngineUnavailable is wrapped by engines for failures worth retrying,
+	// such as an overloaded or restarting model server.
+	ErrEngineUnavailable = errors.New("engine unavailable")
+)
+
+// GenerationPolicy bounds how long a generation may take and how failures
+// before the first token are recovered from. Zero values disable a limit.
+type GenerationPolicy struct {
+	// FirstTokenTimeout fails an attempt that streams no token in time.
+	FirstTokenTimeout time.Duration
+	// TotalTimeout fails a generation that has not ended in time, including
+	// the time spent queued, retrying and falling back.
+	TotalTimeout time.Duration
+	// MaxRetries is how often an engine is retried after a transient failure.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry; it doubles for each one after.
+	RetryBackoff time.Duration
+	// Fallbacks names, in order, the engines tried when the default engine
+	// fails before streaming a token.
+	Fallbacks []string
+}
+
+// namedEngine is an engine together with its registry name.
+type namedEngine struct {
+	name   string
+	engine LLMEngineType
+}
+
+// engineChain returns the named engine, or the default one if name is empty,
+// followed by the policy's other fallbacks.
+func (s *PromptProcessingService) engineChain(name string, policy GenerationPolicy) ([]namedEngine, error) {
+	var engine LLMEngineType
+	var err error
+	if name == "" {
+		name, engine, err = s.engines.Default()
+	} else {
+		engine, err = s.engines.Get(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []namedEngine{{name: name, engine: engine}}
+	for _, fallback := range policy.Fallbacks {
+		if fallback == name {
+			continue
+		}
+		engine, err := s.engines.Get(fallback)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, namedEngine{name: fallback, engine: engine})
+	}
+	return chain, nil
+}
+
+// isTransient reports whether a failed attempt may succeed if retried:
+// timeouts, engines reporting themselves unavailable and streams that broke
+// off. Refused and reset connections count only if reachable, that is if the
+// engine's server is known to be up, so that a wrong host or port fails at
+// once. Other errors, such as TLS failures, bad URLs and unknown hosts, are
+// not going away on their own.
+func isTransient(err error, reachable bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrFirstTokenTimeout) || errors.Is(err, ErrEngineUnavailable) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return reachable
+	}
+
+	// Timed out dials, reads and DNS lookups
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
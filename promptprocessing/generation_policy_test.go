@@ -0,0 +1,77 @@
+package promptprocessing
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// requestError wraps err the way net/http reports a failed request.
+func requestError(err error) error {
+	return &url.Error{Op: "Post", URL: "http://localhost:11434/api/chat", Err: err}
+}
+
+// dialError wraps a system call error the way a failed dial reports it.
+func dialError(errno syscall.Errno) error {
+	return requestError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)})
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		reachable bool
+		want      bool
+	}{
+		{"cancelled", fmt.Errorf("generating: %w", context.Canceled), true, false},
+		{"generation timed out", fmt.Errorf("generating: %w", context.DeadlineExceeded), true, false},
+		{"no first token", fmt.Errorf("%w after 2m0s", ErrFirstTokenTimeout), true, true},
+		{"too many requests", fmt.Errorf("%w: chat completions request failed: 429 Too Many Requests", ErrEngineUnavailable), true, true},
+		{"server error", fmt.Errorf("%w: chat completions request failed: 503 Service Unavailable", ErrEngineUnavailable), true, true},
+		{"stream broke off", fmt.Errorf("chat completion stream ended without [DONE]: %w", io.ErrUnexpectedEOF), true, true},
+		{"read timed out", requestError(&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), true, true},
+		{"DNS timed out", requestError(&net.DNSError{Err: "i/o timeout", Name: "llm.internal", IsTimeout: true}), true, true},
+		{"refused by a healthy server", dialError(syscall.ECONNREFUSED), true, true},
+		{"reset by a healthy server", dialError(syscall.ECONNRESET), true, true},
+		{"refused by an unhealthy server", dialError(syscall.ECONNREFUSED), false, false},
+		{"reset by an unhealthy server", dialError(syscall.ECONNRESET), false, false},
+		{"unknown host", requestError(&net.DNSError{Err: "no such host", Name: "wrong.host", IsNotFound: true}), true, false},
+		{"TLS handshake", requestError(&tls.CertificateVerificationError{Err: errors.New("x509: certificate signed by unknown authority")}), true, false},
+		{"bad URL", &url.Error{Op: "parse", URL: "http://[::1", Err: errors.New("missing ']' in host")}, true, false},
+		{"bad request", errors.New("chat completions request failed: 400 Bad Request: unknown model"), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err, tt.reachable); got != tt.want {
+				t.Errorf("isTransient(%v, %t) = %t, want %t", tt.err, tt.reachable, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReachable(t *testing.T) {
+	healthy := NewFakeEngine("healthy")
+	broken := NewFakeEngine("broken")
+	broken.Err = errors.New("connection refused")
+	r := NewEngineRegistry()
+	r.Register("fake/healthy", healthy)
+	r.Register("fake/broken", broken)
+
+	if !r.Reachable("fake/broken") {
+		t.Error("an engine that was never checked is not reachable")
+	}
+	r.CheckHealth(context.Background())
+	if !r.Reachable("fake/healthy") {
+		t.Error("an engine that passed its health check is not reachable")
+	}
+	if r.Reachable("fake/broken") {
+		t.Error("an engine that failed its health check is reachable")
+	}
+}
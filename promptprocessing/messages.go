@@ -0,0 +1,37 @@
+package promptprocessing
+
+import "demo/chat"
+
+// DefaultSystemPrompt is sent at the start of every conversation.
+const DefaultSystemPrompt = "You are a helpful assistant."
+
+// Role identifies who authored a message in a conversation.
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Message is a single turn of a conversation sent to an LLM engine.
+type Message struct {
+	Role    Role
+	Content string
+}
+
+// buildMessages turns the earlier exchanges of a chat and the new prompt into
+// the message list sent to the engine.
+func buildMessages(systemPrompt string, history []chat.Exchange, promptText string) []Message {
+	messages := make([]Message, 0, 2*len(history)+2)
+	if systemPrompt != "" {
+		messages = append(messages, Message{Role: RoleSystem, Content: systemPrompt})
+	}
+	for _, exchange := range history {
+		messages = append(messages,
+			Message{Role: RoleUser, Content: exchange.Prompt},
+			Message{Role: RoleAssistant, Content: exchange.Response},
+		)
+	}
+	return append(messages, Message{Role: RoleUser, Content: promptText})
+}
@@ -1,83 +1,248 @@
 package promptprocessing
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/tmc/langchaingo/llms"
-	"github.com/tmc/langchaingo/llms/ollama"
 )
 
 // OllamaEngine implements the LLMEngineType interface using the Ollama model.
 type OllamaEngine struct {
-	model       string
-	mu          sync.Mutex
-	activeTasks map[string]context.CancelFunc
+	model     string
+	serverURL string
+
+	mu            sync.Mutex
+	contextLimits map[string]int // context window sizes reported by the server, by model
 }
 
-func NewOllamaEngine(model string) *OllamaEngine {
+// NewOllamaEngine creates an engine for the given model. An empty serverURL
+// uses the Ollama default.
+func NewOllamaEngine(model, serverURL string) *OllamaEngine {
 	return &OllamaEngine{
-		model:       model,
-		activeTasks: make(map[string]context.CancelFunc),
+		model:         model,
+		serverURL:     serverURL,
+		contextLimits: make(map[string]int),
 	}
 }
 
-func (o *OllamaEngine) GenerateTokens(ctx context.Context, prompt string) (<-chan string, error) {
-	o.mu.Lock()
-	ctx, cancel := context.WithCancel(ctx)
-	o.activeTasks[prompt] = cancel
-	o.mu.Unlock()
-
-	tokenChan := make(chan string, 100)
+func (o *OllamaEngine) GenerateTokens(ctx context.Context, id string, messages []Message, opts GenerateOptions) (<-chan Token, error) {
+	tokenChan := make(chan Token, 100)
 
 	go func() {
 		defer close(tokenChan)
-		defer func() {
-			o.mu.Lock()
-			delete(o.activeTasks, prompt)
-			o.mu.Unlock()
-		}()
 
-		llm, err := ollama.New(ollama.WithModel(o.model))
+		llm, err := sharedOllamaClients.get(o.model, o.serverURL)
 		if err != nil {
 			log.Printf("Failed to create Ollama LLM: %v", err)
+			tokenChan <- Token{Err: err}
 			return
 		}
 
-		_, err = llm.Call(ctx, prompt,
-			llms.WithTemperature(0.8),
+		callOpts := append(toCallOptions(opts),
 			llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
 				select {
 				case <-ctx.Done():
 					log.Println("Context canceled, stopping token generation")
 					return ctx.Err()
-				case tokenChan <- string(chunk):
+				case tokenChan <- Token{Text: string(chunk)}:
 				}
 				return nil
 			}),
 		)
+		resp, err := llm.GenerateContent(ctx, toMessageContent(messages), callOpts...)
 
-		if err != nil && ctx.Err() == nil {
-			log.Printf("Error generating tokens: %v", err)
+		if ctx.Err() != nil {
+			// Report cancellation uniformly, whatever error the client wrapped it in
+			err = ctx.Err()
 		}
+		if err != nil {
+			tokenChan <- Token{Err: err}
+			return
+		}
+		tokenChan <- finishToken(resp, opts)
 	}()
 
 	return tokenChan, nil
 }
 
-func (o *OllamaEngine) StopGeneration(ctx context.Context, prompt string) error {
-	o.mu.Lock()
-	defer o.mu.Unlock()
+// finishToken reports how an answer ended from the token counts Ollama
+// returned with it. The client does not pass on the server's done reason, so
+// an answer that used up MaxTokens is taken to have been cut off.
+func finishToken(resp *llms.ContentResponse, opts GenerateOptions) Token {
+	end := Token{FinishReason: FinishStop}
+	if len(resp.Choices) == 0 {
+		return end
+	}
+	info := resp.Choices[0].GenerationInfo
+	end.PromptTokens, _ = info["PromptTokens"].(int)
+	end.CompletionTokens, _ = info["CompletionTokens"].(int)
+	if opts.MaxTokens != nil && end.CompletionTokens >= *opts.MaxTokens {
+		end.FinishReason = FinishLength
+	}
+	return end
+}
+
+func (o *OllamaEngine) Model() string {
+	return o.model
+}
+
+// CheckHealth reports whether the Ollama server answers.
+func (o *OllamaEngine) CheckHealth(ctx context.Context) error {
+	return o.call(ctx, http.MethodGet, "/api/version", nil, nil)
+}
 
-	cancel, exists := o.activeTasks[prompt]
-	if !exists {
-		return fmt.Errorf("prompt %q not found or already completed", prompt)
+// Probe verifies that the server has the engine's model, pulling it first if
+// pull is set and the model is missing.
+func (o *OllamaEngine) Probe(ctx context.Context, pull bool) error {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := o.call(ctx, http.MethodGet, "/api/tags", nil, &tags); err != nil {
+		return err
+	}
+	for _, model := range tags.Models {
+		// Models are listed with their tag, "llama3.1" is stored as "llama3.1:latest"
+		if model.Name == o.model || model.Name == o.model+":latest" {
+			return nil
+		}
 	}
 
-	cancel()
-	delete(o.activeTasks, prompt)
+	if !pull {
+		return fmt.Errorf("model %q is not available on the Ollama server; pull it with `ollama pull %s`", o.model, o.model)
+	}
 
+	log.Printf("Pulling Ollama model %s, this may take a while", o.model)
+	pullRequest := map[string]any{"name": o.model, "stream": false}
+	if err := o.call(ctx, http.MethodPost, "/api/pull", pullRequest, nil); err != nil {
+		return fmt.Errorf("pulling model %q: %w", o.model, err)
+	}
+	log.Printf("Pulled Ollama model %s", o.model)
 	return nil
 }
+
+// ContextLimit returns the context window size the server runs a model with:
+// its num_ctx parameter if set, else the context length the model was trained
+// with. Sizes are asked for once per model.
+func (o *OllamaEngine) ContextLimit(ctx context.Context, model string) (int, error) {
+	o.mu.Lock()
+	limit, cached := o.contextLimits[model]
+	o.mu.Unlock()
+	if cached {
+		return limit, nil
+	}
+
+	var show struct {
+		Parameters string         `json:"parameters"`
+		ModelInfo  map[string]any `json:"model_info"`
+	}
+	if err := o.call(ctx, http.MethodPost, "/api/show", map[string]any{"model": model}, &show); err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(show.Parameters, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "num_ctx" {
+			limit, _ = strconv.Atoi(fields[1])
+		}
+	}
+	if limit <= 0 {
+		for key, value := range show.ModelInfo {
+			if length, ok := value.(float64); ok && strings.HasSuffix(key, ".context_length") {
+				limit = int(length)
+			}
+		}
+	}
+	if limit <= 0 {
+		return 0, fmt.Errorf("ollama does not report the context length of %q", model)
+	}
+
+	o.mu.Lock()
+	o.contextLimits[model] = limit
+	o.mu.Unlock()
+	return limit, nil
+}
+
+// call sends a request to the Ollama API and decodes its JSON response into respData, if not nil.
+func (o *OllamaEngine) call(ctx context.Context, method, path string, reqData, respData any) error {
+	var body io.Reader
+	if reqData != nil {
+		data, err := json.Marshal(reqData)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ollamaBaseURL(o.serverURL)+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ollamaHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("ollama %s %s failed: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if respData == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(respData)
+}
+
+// toCallOptions converts generation options to langchaingo call options.
+func toCallOptions(opts GenerateOptions) []llms.CallOption {
+	callOpts := []llms.CallOption{llms.WithTemperature(opts.temperature())}
+	if opts.Model != "" {
+		callOpts = append(callOpts, llms.WithModel(opts.Model))
+	}
+	if opts.TopP != nil {
+		callOpts = append(callOpts, llms.WithTopP(*opts.TopP))
+	}
+	if opts.TopK != nil {
+		callOpts = append(callOpts, llms.WithTopK(*opts.TopK))
+	}
+	if opts.MaxTokens != nil {
+		callOpts = append(callOpts, llms.WithMaxTokens(*opts.MaxTokens))
+	}
+	if len(opts.Stop) > 0 {
+		callOpts = append(callOpts, llms.WithStopWords(opts.Stop))
+	}
+	if opts.Seed != nil {
+		callOpts = append(callOpts, llms.WithSeed(*opts.Seed))
+	}
+	if opts.RepeatPenalty != nil {
+		callOpts = append(callOpts, llms.WithRepetitionPenalty(*opts.RepeatPenalty))
+	}
+	return callOpts
+}
+
+// toMessageContent converts conversation messages to the langchaingo format.
+func toMessageContent(messages []Message) []llms.MessageContent {
+	content := make([]llms.MessageContent, 0, len(messages))
+	for _, message := range messages {
+		role := llms.ChatMessageTypeHuman
+		switch message.Role {
+		case RoleSystem:
+			role = llms.ChatMessageTypeSystem
+		case RoleAssistant:
+			role = llms.ChatMessageTypeAI
+		}
+		content = append(content, llms.TextParts(role, message.Content))
+	}
+	return content
+}
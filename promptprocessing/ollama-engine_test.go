@@ -0,0 +1,106 @@
+package promptprocessing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOllamaContextLimit(t *testing.T) {
+	shows := map[string]string{
+		"trained":    `{"parameters": "stop \"<|eot_id|>\"", "model_info": {"llama.context_length": 131072}}`,
+		"configured": `{"parameters": "num_ctx 4096\nstop \"<|eot_id|>\"", "model_info": {"llama.context_length": 131072}}`,
+		"unknown":    `{"parameters": "", "model_info": {}}`,
+	}
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if r.URL.Path != "/api/show" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		calls++
+		w.Write([]byte(shows[req.Model]))
+	}))
+	defer server.Close()
+
+	engine := NewOllamaEngine("trained", server.URL)
+	tests := []struct {
+		model   string
+		want    int
+		wantErr bool
+	}{
+		{"trained", 131072, false},
+		{"configured", 4096, false},
+		{"unknown", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := engine.ContextLimit(context.Background(), tt.model)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ContextLimit(%q) = %d, %v, want %d", tt.model, got, err, tt.want)
+		}
+	}
+
+	// Sizes are cached once known
+	calls = 0
+	if _, err := engine.ContextLimit(context.Background(), "trained"); err != nil || calls != 0 {
+		t.Errorf("ContextLimit asked the server again (%d calls, error %v)", calls, err)
+	}
+}
+
+func TestOllamaReportsFinish(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"model": "llama3.1:8b", "message": {"role": "assistant", "content": "one two "}, "done": false}
+{"model": "llama3.1:8b", "message": {"role": "assistant", "content": "three"}, "done": false}
+{"model": "llama3.1:8b", "message": {"role": "assistant", "content": ""}, "done": true, "done_reason": "length", "prompt_eval_count": 12, "eval_count": 3}
+`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		maxTokens *int
+		want      string
+	}{
+		{"cut off", intPtr(3), FinishLength},
+		{"within the limit", intPtr(10), FinishStop},
+		{"without a limit", nil, FinishStop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := NewOllamaEngine("llama3.1:8b", server.URL)
+			tokens, err := engine.GenerateTokens(context.Background(), "id", []Message{{Role: RoleUser, Content: "Count"}}, GenerateOptions{MaxTokens: tt.maxTokens})
+			if err != nil {
+				t.Fatalf("GenerateTokens: %v", err)
+			}
+			var text string
+			var end Token
+			for token := range tokens {
+				if token.Err != nil {
+					t.Fatalf("generation failed: %v", token.Err)
+				}
+				text += token.Text
+				end = token
+			}
+
+			if text != "one two three" {
+				t.Errorf("streamed %q", text)
+			}
+			if end.FinishReason != tt.want || end.PromptTokens != 12 || end.CompletionTokens != 3 {
+				t.Errorf("ended with %+v, want %s after 12 prompt and 3 completion tokens", end, tt.want)
+			}
+		})
+	}
+}
+
+func intPtr(n int) *int {
+	return &n
+}
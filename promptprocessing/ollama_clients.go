@@ -0,0 +1,79 @@
+package promptprocessing
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms/ollama"
+)
+
+// ollamaHTTPClient is shared by every Ollama client so connections to the
+// server are pooled across generations.
+var ollamaHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 16,
+	},
+}
+
+// ollamaClients caches one langchaingo client per model and server URL.
+type ollamaClients struct {
+	mu      sync.Mutex
+	clients map[string]*ollama.LLM
+}
+
+// sharedOllamaClients is used by every OllamaEngine.
+var sharedOllamaClients = &ollamaClients{
+	clients: make(map[string]*ollama.LLM),
+}
+
+// get returns the client for a model and server URL, creating it on first use.
+// Failed creations are not cached, so they are retried by the next call.
+func (c *ollamaClients) get(model, serverURL string) (*ollama.LLM, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := model + "\x00" + serverURL
+	if llm, exists := c.clients[key]; exists {
+		return llm, nil
+	}
+
+	opts := []ollama.Option{
+		ollama.WithModel(model),
+		ollama.WithHTTPClient(ollamaHTTPClient),
+	}
+	if serverURL != "" {
+		opts = append(opts, ollama.WithServerURL(serverURL))
+	}
+	llm, err := ollama.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.clients[key] = llm
+	return llm, nil
+}
+
+// ollamaBaseURL returns the server URL the Ollama client talks to, resolving
+// an empty serverURL from OLLAMA_HOST the way the client does.
+func ollamaBaseURL(serverURL string) string {
+	if serverURL != "" {
+		return strings.TrimSuffix(serverURL, "/")
+	}
+
+	scheme, hostport, ok := strings.Cut(os.Getenv("OLLAMA_HOST"), "://")
+	if !ok {
+		scheme, hostport = "http", os.Getenv("OLLAMA_HOST")
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = "127.0.0.1", "11434"
+		if ip := net.ParseIP(strings.Trim(os.Getenv("OLLAMA_HOST"), "[]")); ip != nil {
+			host = ip.String()
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
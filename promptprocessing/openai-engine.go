@@ -0,0 +1,272 @@
+package promptprocessing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// OpenAIEngine implements the LLMEngineType interface against any server
+// speaking the OpenAI chat completions streaming protocol, such as llama.cpp
+// server, vLLM or LocalAI.
+type OpenAIEngine struct {
+	model   string
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// NewOpenAIEngine creates an engine for the given model. baseURL is the API
+// root including the version, e.g. "http://localhost:8080/v1". The API key is
+// optional for local servers.
+func NewOpenAIEngine(model, baseURL, apiKey string) *OpenAIEngine {
+	return &OpenAIEngine{
+		model:   model,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{},
+	}
+}
+
+type chatCompletionMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model       string                  `json:"model"`
+	Messages    []chatCompletionMessage `json:"messages"`
+	Stream      bool                    `json:"stream"`
+	Temperature float64                 `json:"temperature"`
+	TopP        *float64                `json:"top_p,omitempty"`
+	MaxTokens   *int                    `json:"max_tokens,omitempty"`
+	Stop        []string                `json:"stop,omitempty"`
+	Seed        *int                    `json:"seed,omitempty"`
+	// Not part of the OpenAI API, but understood by llama.cpp server and vLLM.
+	TopK          *int     `json:"top_k,omitempty"`
+	RepeatPenalty *float64 `json:"repeat_penalty,omitempty"`
+
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+type chatCompletionChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	// Usage is sent in a last chunk without choices.
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	// Error is set by servers that fail after the stream started.
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+func (o *OpenAIEngine) GenerateTokens(ctx context.Context, id string, messages []Message, opts GenerateOptions) (<-chan Token, error) {
+	tokenChan := make(chan Token, 100)
+
+	go func() {
+		defer close(tokenChan)
+
+		end, err := o.stream(ctx, messages, opts, func(text string) error {
+			select {
+			case <-ctx.Done():
+				log.Println("Context canceled, stopping token generation")
+				return ctx.Err()
+			case tokenChan <- Token{Text: text}:
+			}
+			return nil
+		})
+
+		if ctx.Err() != nil {
+			// Report cancellation uniformly, whatever error the client wrapped it in
+			err = ctx.Err()
+		}
+		if err != nil {
+			end = Token{Err: err}
+		}
+		tokenChan <- end
+	}()
+
+	return tokenChan, nil
+}
+
+// stream sends a streaming chat completion request and calls onText for every
+// content delta until the server reports the end of the stream, then returns
+// the finish reason and token usage the server reported. A stream that
+// breaks off or carries an error object fails.
+func (o *OpenAIEngine) stream(ctx context.Context, messages []Message, opts GenerateOptions, onText func(string) error) (Token, error) {
+	body := chatCompletionRequest{
+		Model:         opts.model(o.model),
+		Messages:      make([]chatCompletionMessage, 0, len(messages)),
+		Stream:        true,
+		Temperature:   opts.temperature(),
+		TopP:          opts.TopP,
+		MaxTokens:     opts.MaxTokens,
+		Stop:          opts.Stop,
+		Seed:          opts.Seed,
+		TopK:          opts.TopK,
+		RepeatPenalty: opts.RepeatPenalty,
+	}
+	body.StreamOptions.IncludeUsage = true
+	for _, message := range messages {
+		body.Messages = append(body.Messages, chatCompletionMessage{
+			Role:    string(message.Role),
+			Content: message.Content,
+		})
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return Token{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return Token{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("chat completions request failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			err = fmt.Errorf("%w: %w", ErrEngineUnavailable, err)
+		}
+		return Token{}, err
+	}
+
+	var end Token
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return end, nil
+		}
+
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return Token{}, fmt.Errorf("decoding chat completion chunk: %w", err)
+		}
+		if chunk.Error != nil {
+			err := fmt.Errorf("chat completion stream failed: %s", chunk.Error.Message)
+			if chunk.Error.Type != "invalid_request_error" {
+				err = fmt.Errorf("%w: %w", ErrEngineUnavailable, err)
+			}
+			return Token{}, err
+		}
+		if chunk.Usage != nil {
+			end.PromptTokens = chunk.Usage.PromptTokens
+			end.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				end.FinishReason = *choice.FinishReason
+			}
+			if choice.Delta.Content == "" {
+				continue
+			}
+			if err := onText(choice.Delta.Content); err != nil {
+				return Token{}, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Token{}, err
+	}
+	// The server closed the stream without marking its end
+	return Token{}, fmt.Errorf("chat completion stream ended without [DONE]: %w", io.ErrUnexpectedEOF)
+}
+
+func (o *OpenAIEngine) Model() string {
+	return o.model
+}
+
+// CheckHealth reports whether the server answers its model listing.
+func (o *OpenAIEngine) CheckHealth(ctx context.Context) error {
+	_, err := o.models(ctx)
+	return err
+}
+
+// Probe verifies that the server serves the engine's model. The OpenAI API
+// cannot pull models, so pull is ignored.
+func (o *OpenAIEngine) Probe(ctx context.Context, pull bool) error {
+	models, err := o.models(ctx)
+	if err != nil {
+		return err
+	}
+	for _, model := range models {
+		if model == o.model {
+			return nil
+		}
+	}
+	return fmt.Errorf("model %q is not served by %s, available: %v", o.model, o.baseURL, models)
+}
+
+// models lists the IDs of the models the server serves.
+func (o *OpenAIEngine) models(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("listing models failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("decoding model list: %w", err)
+	}
+
+	models := make([]string, 0, len(list.Data))
+	for _, model := range list.Data {
+		models = append(models, model.ID)
+	}
+	return models, nil
+}
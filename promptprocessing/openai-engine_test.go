@@ -0,0 +1,57 @@
+package promptprocessing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAIReportsFinish(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req chatCompletionRequest
+		if r.URL.Path != "/v1/chat/completions" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !req.StreamOptions.IncludeUsage {
+			t.Error("request does not ask for the usage")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"choices": [{"delta": {"role": "assistant", "content": "one two "}, "finish_reason": null}]}
+
+data: {"choices": [{"delta": {"content": "three"}, "finish_reason": null}]}
+
+data: {"choices": [{"delta": {}, "finish_reason": "length"}]}
+
+data: {"choices": [], "usage": {"prompt_tokens": 12, "completion_tokens": 3, "total_tokens": 15}}
+
+data: [DONE]
+
+`))
+	}))
+	defer server.Close()
+
+	engine := NewOpenAIEngine("gpt-4o-mini", server.URL+"/v1", "")
+	tokens, err := engine.GenerateTokens(context.Background(), "id", []Message{{Role: RoleUser, Content: "Count"}}, GenerateOptions{})
+	if err != nil {
+		t.Fatalf("GenerateTokens: %v", err)
+	}
+	var text string
+	var end Token
+	for token := range tokens {
+		if token.Err != nil {
+			t.Fatalf("generation failed: %v", token.Err)
+		}
+		text += token.Text
+		end = token
+	}
+
+	if text != "one two three" {
+		t.Errorf("streamed %q", text)
+	}
+	if end.FinishReason != FinishLength || end.PromptTokens != 12 || end.CompletionTokens != 3 {
+		t.Errorf("ended with %+v, want length after 12 prompt and 3 completion tokens", end)
+	}
+}
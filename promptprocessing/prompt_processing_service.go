@@ -2,65 +2,477 @@ package promptprocessing
 
 import (
 	"context"
+	"demo/chat"
+	"demo/events"
+	"demo/persona"
 	"demo/pubsub"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Token is a chunk of generated text. The last value sent before the channel is
+// closed carries Err if generation ended with an error or was cancelled, or
+// else may report how the answer ended: FinishReason and the token counts of
+// the prompt and the answer as the engine measured them. Engines leave what
+// they do not know empty or zero.
+type Token struct {
+	Text string
+	Err  error
+
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Finish reasons reported by engines, named as in the OpenAI API.
+const (
+	FinishStop   = "stop"   // the model ended its answer
+	FinishLength = "length" // the answer was cut off at MaxTokens or the context window
 )
 
 // LLMEngineType defines the interface for any LLM engine.
 type LLMEngineType interface {
-	// Starts generating tokens and returns a channel for streaming responses.
-	GenerateTokens(ctx context.Context, prompt string) (<-chan string, error)
-	// Attempts to stop a request mid-processing.
-	StopGeneration(ctx context.Context, prompt string) error
+	// Starts generating the next assistant message of a conversation for the request identified by id
+	// and returns a channel for streaming responses.
+	GenerateTokens(ctx context.Context, id string, messages []Message, opts GenerateOptions) (<-chan Token, error)
+	// Returns the name of the model the engine generates with.
+	Model() string
 }
 
 // PromptProcessingService handles processing prompts.
 type PromptProcessingService struct {
-	pubSub    *pubsub.PubSub
-	llmEngine LLMEngineType
+	pubSub       *pubsub.PubSub
+	engines      *EngineRegistry
+	chatService  *chat.ChatService
+	personas     *persona.PersonaService
+	tokenBudget  *TokenBudget
+	scheduler    *Scheduler
+	systemPrompt string
+	policy       GenerationPolicy
+
+	mu      sync.Mutex
+	active  map[string]context.CancelFunc // cancels queued and running generations by prompt ID
+	running sync.WaitGroup
+	closing bool // no new generations are started
 }
 
-// NewPromptProcessingService creates a new PromptProcessingService with the given LLM engine.
-func NewPromptProcessingService(pubSub *pubsub.PubSub, llmEngine LLMEngineType) *PromptProcessingService {
+// ErrShuttingDown is reported for prompts submitted once Shutdown has begun.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// NewPromptProcessingService creates a new PromptProcessingService generating with the registry's engines.
+// The chat service supplies the earlier turns of a chat so follow-up prompts are answered in context,
+// and the persona service the system prompt of chats created with a persona.
+func NewPromptProcessingService(pubSub *pubsub.PubSub, engines *EngineRegistry, chatService *chat.ChatService, personas *persona.PersonaService) *PromptProcessingService {
 	return &PromptProcessingService{
-		pubSub:    pubSub,
-		llmEngine: llmEngine,
+		pubSub:       pubSub,
+		engines:      engines,
+		chatService:  chatService,
+		personas:     personas,
+		tokenBudget:  NewTokenBudget(),
+		scheduler:    NewScheduler(pubSub, DefaultMaxConcurrent),
+		systemPrompt: DefaultSystemPrompt,
+		active:       make(map[string]context.CancelFunc),
 	}
 }
 
+// Start subscribes the service to PromptSubmitted and StopRequested events.
 func (s *PromptProcessingService) Start() {
-	s.pubSub.Subscribe("PromptSubmitted", func(payload interface{}) {
-		data, ok := payload.(map[string]interface{})
-		if !ok {
-			log.Println("Invalid payload for PromptSubmitted event")
+	pubsub.Subscribe(s.pubSub, func(event events.PromptSubmitted) {
+		log.Printf("Processing prompt: ChatID=%s, PromptID=%s, Text=%s\n", event.ChatID, event.PromptID, event.PromptText)
+
+		ctx, done, err := s.track(event.PromptID)
+		if err != nil {
+			s.fail(event.ChatID, event.PromptID, err)
+			return
+		}
+		defer done()
+
+		s.generate(ctx, event.ChatID, event.PromptID, event.PromptText)
+	})
+
+	pubsub.Subscribe(s.pubSub, func(event events.StopRequested) {
+		s.mu.Lock()
+		cancel, exists := s.active[event.PromptID]
+		s.mu.Unlock()
+		if !exists {
+			log.Printf("Error stopping generation: no generation running for PromptID=%s", event.PromptID)
 			return
 		}
 
-		// Extract event data
-		chatID := data["chatId"].(string)
-		promptID := data["promptId"].(string)
-		promptText := data["promptText"].(string)
+		// Cancels the generation whether it is still queued, retrying or streaming
+		cancel()
+	})
+}
+
+// Complete answers a conversation given by the caller rather than read from a
+// chat, publishing the same events as a submitted prompt under the given IDs.
+// The chat ID may be empty if the generation belongs to no chat. A non-empty
+// engineName starts the fallback chain with that engine instead of the
+// default one. Complete returns once the generation ended; it can be stopped
+// with a StopRequested event for promptID.
+func (s *PromptProcessingService) Complete(chatID, promptID, engineName string, messages []Message, opts GenerateOptions) error {
+	ctx, done, err := s.track(promptID)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	s.run(ctx, chatID, promptID, engineName, messages, opts)
+	return nil
+}
+
+// track registers a generation so that it can be stopped and is waited for
+// on shutdown. The returned function must be called once it ended.
+func (s *PromptProcessingService) track(promptID string) (context.Context, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return nil, nil, ErrShuttingDown
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.active[promptID] = cancel
+	s.running.Add(1)
+
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.active, promptID)
+		s.mu.Unlock()
+		cancel()
+		s.running.Done()
+	}, nil
+}
+
+// SetPolicy sets the timeouts, retries and fallback engines of later generations.
+func (s *PromptProcessingService) SetPolicy(policy GenerationPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		log.Printf("Processing prompt: ChatID=%s, PromptID=%s, Text=%s\n", chatID, promptID, promptText)
+	s.policy = policy
+}
+
+// SetMaxConcurrent limits how many generations the named engine runs at once.
+// Further prompts wait in its queue.
+func (s *PromptProcessingService) SetMaxConcurrent(engineName string, limit int) {
+	s.scheduler.SetLimit(engineName, limit)
+}
+
+// SetContextLimits sets the context window sizes of models by name or
+// family, overriding those the engines report, see TokenBudget.
+func (s *PromptProcessingService) SetContextLimits(limits map[string]int) {
+	s.tokenBudget.SetContextLimits(limits)
+}
+
+// Scheduler returns the scheduler that queues the generations of each
+// engine, for other users of the engines to wait their turn.
+func (s *PromptProcessingService) Scheduler() *Scheduler {
+	return s.scheduler
+}
+
+// QueuePosition returns the engine a prompt waits for and its place in line,
+// or ok false if the prompt is not queued.
+func (s *PromptProcessingService) QueuePosition(promptID string) (engineName string, position int, ok bool) {
+	return s.scheduler.Position(promptID)
+}
+
+// Shutdown stops accepting prompts and waits for the queued and running
+// generations to end. Those still queued or running when ctx is done are
+// cancelled, and Shutdown returns once their cancellation has been published.
+func (s *PromptProcessingService) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
 
-		// Generate tokens using the LLM engine
-		ctx := context.Background()
-		tokenChan, err := s.llmEngine.GenerateTokens(ctx, promptText)
+	s.mu.Lock()
+	for promptID, cancel := range s.active {
+		log.Printf("Cancelling generation of PromptID=%s for shutdown", promptID)
+		cancel()
+	}
+	s.mu.Unlock()
+
+	<-finished
+	return nil
+}
+
+// fail publishes a GenerationFailed event for a prompt that could not be answered.
+func (s *PromptProcessingService) fail(chatID, promptID string, err error) {
+	log.Printf("Error generating tokens: %v", err)
+	pubsub.Publish(s.pubSub, events.GenerationFailed{
+		ChatID:   chatID,
+		PromptID: promptID,
+		Error:    err.Error(),
+	})
+}
+
+// systemPromptFor returns the system prompt of the chat's persona, or the
+// service's default if the chat has no persona or it has since been deleted.
+func (s *PromptProcessingService) systemPromptFor(chatID string) (string, error) {
+	personaID, err := s.chatService.GetPersonaID(chatID)
+	if err != nil {
+		return "", err
+	}
+	if personaID == "" {
+		return s.systemPrompt, nil
+	}
+
+	p, err := s.personas.GetPersona(personaID)
+	if errors.Is(err, persona.ErrPersonaNotFound) {
+		log.Printf("Persona %s of ChatID=%s no longer exists, using the default system prompt", personaID, chatID)
+		return s.systemPrompt, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return p.SystemPrompt(), nil
+}
+
+// generate answers a prompt in the context of its chat's earlier exchanges.
+// Generation ends early if ctx is cancelled.
+func (s *PromptProcessingService) generate(ctx context.Context, chatID, promptID, promptText string) {
+	history, err := s.chatService.GetHistory(chatID, promptID)
+	if err != nil {
+		s.fail(chatID, promptID, fmt.Errorf("loading history: %w", err))
+		return
+	}
+
+	settings, err := s.chatService.GetPromptSettings(chatID, promptID)
+	if err != nil {
+		s.fail(chatID, promptID, fmt.Errorf("loading settings: %w", err))
+		return
+	}
+	opts := optionsFromSettings(settings)
+
+	systemPrompt, err := s.systemPromptFor(chatID)
+	if err != nil {
+		s.fail(chatID, promptID, fmt.Errorf("loading system prompt: %w", err))
+		return
+	}
+
+	s.run(ctx, chatID, promptID, "", buildMessages(systemPrompt, history, promptText), opts)
+}
+
+// run answers a conversation with the first engine of the fallback chain that
+// streams a token, and publishes the lifecycle events of the generation. The
+// chain starts with the named engine, or the default one if engineName is
+// empty. Generation ends early if ctx is cancelled.
+func (s *PromptProcessingService) run(ctx context.Context, chatID, promptID, engineName string, conversation []Message, opts GenerateOptions) {
+	s.mu.Lock()
+	policy := s.policy
+	s.mu.Unlock()
+
+	chain, err := s.engineChain(engineName, policy)
+	if err != nil {
+		s.fail(chatID, promptID, err)
+		return
+	}
+
+	if policy.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.TotalTimeout)
+		defer cancel()
+	}
+
+	var startedAt time.Time
+	tokenCount := 0
+	var end Token
+	for i, candidate := range chain {
+		if i > 0 {
+			log.Printf("Falling back from %s to %s for PromptID=%s: %v", chain[i-1].name, candidate.name, promptID, err)
+			pubsub.Publish(s.pubSub, events.GenerationFallback{
+				ChatID:     chatID,
+				PromptID:   promptID,
+				FromEngine: chain[i-1].name,
+				ToEngine:   candidate.name,
+				Error:      err.Error(),
+			})
+			// A model chosen for the chat belongs to the primary engine
+			opts.Model = ""
+		}
+
+		var release func()
+		release, err = s.scheduler.Acquire(ctx, candidate.name, chatID, promptID)
 		if err != nil {
-			log.Printf("Error generating tokens: %v", err)
-			return
+			break
 		}
 
-		// Publish TokensGenerated events for each token
+		model := opts.model(candidate.engine.Model())
+		contextLimit := s.tokenBudget.ContextLimit(ctx, candidate.engine, model)
+		messages, truncation := s.tokenBudget.Fit(contextLimit, opts.answerReserve(), conversation)
+		if truncation.DroppedMessages > 0 {
+			log.Printf("Dropped %d messages (%d tokens) of ChatID=%s to fit the context of %s", truncation.DroppedMessages, truncation.DroppedTokens, chatID, model)
+		}
+
+		if i == 0 {
+			startedAt = time.Now()
+			pubsub.Publish(s.pubSub, events.GenerationStarted{
+				ChatID:          chatID,
+				PromptID:        promptID,
+				StartedAt:       startedAt,
+				Engine:          candidate.name,
+				Model:           model,
+				ContextLimit:    truncation.ContextLimit,
+				PromptTokens:    truncation.PromptTokens,
+				DroppedMessages: truncation.DroppedMessages,
+				DroppedTokens:   truncation.DroppedTokens,
+			})
+		}
+
+		tokenCount, end, err = s.generateWithRetries(ctx, policy, chatID, promptID, candidate, messages, opts)
+		release()
+
+		// Only a generation that failed before streaming anything can fall back
+		if err == nil || tokenCount > 0 || ctx.Err() != nil {
+			break
+		}
+	}
+
+	// Publish how generation ended
+	switch {
+	case err == nil:
+		pubsub.Publish(s.pubSub, events.GenerationCompleted{
+			ChatID:           chatID,
+			PromptID:         promptID,
+			TokenCount:       tokenCount,
+			Duration:         time.Since(startedAt),
+			FinishReason:     end.FinishReason,
+			PromptTokens:     end.PromptTokens,
+			CompletionTokens: end.CompletionTokens,
+		})
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		log.Printf("Generation of PromptID=%s timed out: %v", promptID, err)
+		pubsub.Publish(s.pubSub, events.GenerationFailed{
+			ChatID:     chatID,
+			PromptID:   promptID,
+			TokenCount: tokenCount,
+			Error:      fmt.Sprintf("generation timed out after %s", policy.TotalTimeout),
+		})
+	case errors.Is(err, context.Canceled):
+		pubsub.Publish(s.pubSub, events.GenerationCancelled{
+			ChatID:     chatID,
+			PromptID:   promptID,
+			TokenCount: tokenCount,
+		})
+	default:
+		log.Printf("Error generating tokens: %v", err)
+		pubsub.Publish(s.pubSub, events.GenerationFailed{
+			ChatID:     chatID,
+			PromptID:   promptID,
+			TokenCount: tokenCount,
+			Error:      err.Error(),
+		})
+	}
+}
+
+// generateWithRetries streams the answer of one engine, retrying transient
+// failures with exponential backoff as long as no token has been streamed.
+func (s *PromptProcessingService) generateWithRetries(ctx context.Context, policy GenerationPolicy, chatID, promptID string, candidate namedEngine, messages []Message, opts GenerateOptions) (int, Token, error) {
+	delay := policy.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		tokenCount, end, err := s.stream(ctx, policy, chatID, promptID, candidate.engine, messages, opts)
+		if err == nil || tokenCount > 0 || attempt > policy.MaxRetries || !isTransient(err, s.engines.Reachable(candidate.name)) || ctx.Err() != nil {
+			return tokenCount, end, err
+		}
+
+		log.Printf("Retrying PromptID=%s on %s in %s after attempt %d failed: %v", promptID, candidate.name, delay, attempt, err)
+		pubsub.Publish(s.pubSub, events.GenerationRetrying{
+			ChatID:   chatID,
+			PromptID: promptID,
+			Engine:   candidate.name,
+			Attempt:  attempt,
+			Delay:    delay,
+			Error:    err.Error(),
+		})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return 0, Token{}, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// stream runs one generation attempt and publishes its tokens. It returns
+// how many tokens were streamed, how the engine reported the answer ended and
+// the error the attempt ended with.
+func (s *PromptProcessingService) stream(ctx context.Context, policy GenerationPolicy, chatID, promptID string, engine LLMEngineType, messages []Message, opts GenerateOptions) (int, Token, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Give up on the attempt if the engine stays silent for too long
+	var timedOut atomic.Bool
+	firstToken := make(chan struct{})
+	if policy.FirstTokenTimeout > 0 {
 		go func() {
-			for token := range tokenChan {
-				log.Printf("Generated token for ChatID=%s, PromptID=%s: %s\n", "***", promptID, token)
-				s.pubSub.Publish("TokensGenerated", map[string]interface{}{
-					"chatId":       chatID,
-					"promptId":     promptID,
-					"responseText": token,
-				})
+			select {
+			case <-firstToken:
+			case <-ctx.Done():
+			case <-time.After(policy.FirstTokenTimeout):
+				timedOut.Store(true)
+				cancel()
 			}
 		}()
-	})
+	}
+
+	tokenChan, err := engine.GenerateTokens(ctx, promptID, messages, opts)
+	if err != nil {
+		close(firstToken)
+		return 0, Token{}, err
+	}
+
+	tokenCount, offset := 0, 0
+	var end Token
+	for token := range tokenChan {
+		if token.Err != nil {
+			err = token.Err
+			continue
+		}
+		if token.FinishReason != "" || token.PromptTokens > 0 || token.CompletionTokens > 0 {
+			end = Token{
+				FinishReason:     token.FinishReason,
+				PromptTokens:     token.PromptTokens,
+				CompletionTokens: token.CompletionTokens,
+			}
+		}
+		if token.Text == "" {
+			continue
+		}
+
+		if tokenCount == 0 {
+			close(firstToken)
+		}
+		tokenCount++
+		log.Printf("Generated token for ChatID=%s, PromptID=%s: %s\n", "***", promptID, token.Text)
+		pubsub.Publish(s.pubSub, events.TokensGenerated{
+			ChatID:       chatID,
+			PromptID:     promptID,
+			ResponseText: token.Text,
+			Offset:       offset,
+		})
+		offset += len(token.Text)
+	}
+	if tokenCount == 0 {
+		close(firstToken)
+	}
+
+	if err != nil && tokenCount == 0 && timedOut.Load() {
+		err = fmt.Errorf("%w after %s", ErrFirstTokenTimeout, policy.FirstTokenTimeout)
+	}
+	return tokenCount, end, err
 }
@@ -0,0 +1,218 @@
+package promptprocessing
+
+import (
+	"context"
+	"demo/events"
+	"demo/pubsub"
+	"sync"
+)
+
+// DefaultMaxConcurrent is how many generations an engine runs at once unless
+// configured otherwise.
+const DefaultMaxConcurrent = 1
+
+// ticket is a prompt waiting for an engine slot.
+type ticket struct {
+	chatID   string
+	promptID string
+	ready    chan struct{} // closed once a slot is granted
+	position int           // last published queue position
+}
+
+// engineQueue tracks the running and waiting generations of one engine.
+// Waiting prompts are queued per chat, and chats take turns so one busy chat
+// cannot hold up the others.
+type engineQueue struct {
+	limit   int
+	running int
+	chats   []string             // chats with waiting prompts, in turn order
+	waiting map[string][]*ticket // waiting prompts by chat ID, oldest first
+}
+
+// order returns the waiting prompts in the order they will be started.
+func (q *engineQueue) order() []*ticket {
+	var tickets []*ticket
+	for round := 0; ; round++ {
+		added := false
+		for _, chatID := range q.chats {
+			if round < len(q.waiting[chatID]) {
+				tickets = append(tickets, q.waiting[chatID][round])
+				added = true
+			}
+		}
+		if !added {
+			return tickets
+		}
+	}
+}
+
+// next removes and returns the prompt whose turn it is.
+func (q *engineQueue) next() *ticket {
+	chatID := q.chats[0]
+	q.chats = q.chats[1:]
+
+	t := q.waiting[chatID][0]
+	q.waiting[chatID] = q.waiting[chatID][1:]
+	if len(q.waiting[chatID]) == 0 {
+		delete(q.waiting, chatID)
+	} else {
+		// The chat goes to the back of the line for its next prompt
+		q.chats = append(q.chats, chatID)
+	}
+	return t
+}
+
+// remove takes a waiting prompt out of the queue and reports whether it was there.
+func (q *engineQueue) remove(promptID string) bool {
+	for chatID, tickets := range q.waiting {
+		for i, t := range tickets {
+			if t.promptID != promptID {
+				continue
+			}
+			q.waiting[chatID] = append(tickets[:i:i], tickets[i+1:]...)
+			if len(q.waiting[chatID]) == 0 {
+				delete(q.waiting, chatID)
+				for j, id := range q.chats {
+					if id == chatID {
+						q.chats = append(q.chats[:j:j], q.chats[j+1:]...)
+						break
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Scheduler limits how many generations each engine runs at once and queues
+// the rest, publishing a GenerationQueued event whenever a waiting prompt's
+// position changes.
+type Scheduler struct {
+	pubSub       *pubsub.PubSub
+	defaultLimit int
+
+	mu     sync.Mutex
+	queues map[string]*engineQueue // by engine name
+}
+
+// NewScheduler creates a Scheduler running up to defaultLimit generations per engine.
+func NewScheduler(pubSub *pubsub.PubSub, defaultLimit int) *Scheduler {
+	return &Scheduler{
+		pubSub:       pubSub,
+		defaultLimit: defaultLimit,
+		queues:       make(map[string]*engineQueue),
+	}
+}
+
+// SetLimit changes how many generations the named engine runs at once.
+func (s *Scheduler) SetLimit(engineName string, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queue(engineName)
+	q.limit = limit
+	s.dispatch(engineName, q)
+}
+
+// queue returns the queue of an engine, creating it if needed. The caller must hold s.mu.
+func (s *Scheduler) queue(engineName string) *engineQueue {
+	q, exists := s.queues[engineName]
+	if !exists {
+		q = &engineQueue{
+			limit:   s.defaultLimit,
+			waiting: make(map[string][]*ticket),
+		}
+		s.queues[engineName] = q
+	}
+	return q
+}
+
+// Acquire waits until the named engine may start a generation for the prompt
+// and returns a function releasing the slot once the generation ended. It
+// fails if ctx is done while the prompt is waiting.
+func (s *Scheduler) Acquire(ctx context.Context, engineName, chatID, promptID string) (func(), error) {
+	s.mu.Lock()
+	q := s.queue(engineName)
+	t := &ticket{
+		chatID:   chatID,
+		promptID: promptID,
+		ready:    make(chan struct{}),
+	}
+	if _, exists := q.waiting[chatID]; !exists {
+		q.chats = append(q.chats, chatID)
+	}
+	q.waiting[chatID] = append(q.waiting[chatID], t)
+	s.dispatch(engineName, q)
+	s.mu.Unlock()
+
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		s.mu.Lock()
+		waiting := q.remove(promptID)
+		if waiting {
+			s.publishPositions(engineName, q)
+		}
+		s.mu.Unlock()
+		if waiting {
+			return nil, ctx.Err()
+		}
+		// The slot was granted as ctx ended
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			q.running--
+			s.dispatch(engineName, q)
+		})
+	}, nil
+}
+
+// Position returns the engine a prompt waits for and its place in that
+// engine's queue. ok is false if the prompt is not waiting.
+func (s *Scheduler) Position(promptID string) (engineName string, position int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for engineName, q := range s.queues {
+		for i, t := range q.order() {
+			if t.promptID == promptID {
+				return engineName, i + 1, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// dispatch starts waiting prompts while the engine has free slots, then
+// publishes the new positions of those still waiting. The caller must hold s.mu.
+func (s *Scheduler) dispatch(engineName string, q *engineQueue) {
+	for q.running < q.limit && len(q.chats) > 0 {
+		q.running++
+		close(q.next().ready)
+	}
+	s.publishPositions(engineName, q)
+}
+
+// publishPositions publishes a GenerationQueued event for every waiting
+// prompt whose position changed. Events are published under s.mu so that
+// subscribers see positions in the order they were assigned. The caller must hold s.mu.
+func (s *Scheduler) publishPositions(engineName string, q *engineQueue) {
+	for i, t := range q.order() {
+		if t.position == i+1 {
+			continue
+		}
+		t.position = i + 1
+		pubsub.Publish(s.pubSub, events.GenerationQueued{
+			ChatID:   t.chatID,
+			PromptID: t.promptID,
+			Engine:   engineName,
+			Position: t.position,
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package promptprocessing
+
+import (
+	"context"
+	"demo/events"
+	"demo/pubsub"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// grant is a slot granted to a waiting prompt.
+type grant struct {
+	promptID string
+	release  func()
+}
+
+// enqueue makes the prompt wait for the engine in the background and
+// returns once it is queued. Its slot is sent on granted, or its error on
+// failed.
+func enqueue(t *testing.T, ctx context.Context, s *Scheduler, chatID, promptID string, granted chan<- grant, failed chan<- error) {
+	t.Helper()
+
+	go func() {
+		release, err := s.Acquire(ctx, "engine", chatID, promptID)
+		if err != nil {
+			failed <- err
+			return
+		}
+		granted <- grant{promptID, release}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, _, ok := s.Position(promptID); ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("prompt %s was not queued", promptID)
+}
+
+// nextGrant waits for the next prompt to be granted a slot.
+func nextGrant(t *testing.T, granted <-chan grant) grant {
+	t.Helper()
+
+	select {
+	case g := <-granted:
+		return g
+	case <-time.After(time.Second):
+		t.Fatal("no prompt was granted a slot")
+		return grant{}
+	}
+}
+
+func TestSchedulerChatsTakeTurns(t *testing.T) {
+	s := NewScheduler(pubsub.NewPubSub(), 1)
+	release, err := s.Acquire(context.Background(), "engine", "busy", "running")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	granted := make(chan grant)
+	failed := make(chan error, 1)
+	for _, p := range []struct{ chatID, promptID string }{
+		{"a", "a1"}, {"a", "a2"}, {"a", "a3"}, {"b", "b1"}, {"c", "c1"}, {"c", "c2"},
+	} {
+		enqueue(t, context.Background(), s, p.chatID, p.promptID, granted, failed)
+	}
+
+	want := []string{"a1", "b1", "c1", "a2", "c2", "a3"}
+	for i, promptID := range want {
+		if _, position, _ := s.Position(promptID); position != i+1 {
+			t.Errorf("%s is at position %d, want %d", promptID, position, i+1)
+		}
+	}
+
+	var order []string
+	for range want {
+		release()
+		g := nextGrant(t, granted)
+		order = append(order, g.promptID)
+		release = g.release
+	}
+	release()
+	if !slices.Equal(order, want) {
+		t.Errorf("prompts started in order %v, want %v", order, want)
+	}
+}
+
+func TestSchedulerCancelledAcquireLeavesQueue(t *testing.T) {
+	ps := pubsub.NewPubSub()
+	var positions []int
+	sub := pubsub.Subscribe(ps, func(event events.GenerationQueued) {
+		if event.PromptID == "later" {
+			positions = append(positions, event.Position)
+		}
+	}, pubsub.Ordered())
+	defer sub.Unsubscribe()
+
+	s := NewScheduler(ps, 1)
+	release, err := s.Acquire(context.Background(), "engine", "busy", "running")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	granted := make(chan grant)
+	failed := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	enqueue(t, ctx, s, "x", "cancelled", granted, failed)
+	enqueue(t, context.Background(), s, "y", "later", granted, failed)
+
+	cancel()
+	select {
+	case err := <-failed:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Acquire failed with %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire kept waiting after its context was cancelled")
+	}
+	if _, _, ok := s.Position("cancelled"); ok {
+		t.Error("cancelled prompt is still queued")
+	}
+	if _, position, _ := s.Position("later"); position != 1 {
+		t.Errorf("prompt behind the cancelled one is at position %d, want 1", position)
+	}
+
+	release()
+	if g := nextGrant(t, granted); g.promptID != "later" {
+		t.Errorf("%s was granted the slot, want later", g.promptID)
+	} else {
+		g.release()
+	}
+	if err := sub.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if !slices.Equal(positions, []int{2, 1}) {
+		t.Errorf("later was queued at positions %v, want [2 1]", positions)
+	}
+}
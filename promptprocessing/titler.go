@@ -0,0 +1,218 @@
+package promptprocessing
+
+import (
+	"context"
+	"demo/chat"
+	"demo/events"
+	"demo/pubsub"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// titleTimeout bounds how long writing a title may take.
+	titleTimeout = time.Minute
+	// titleMaxLen is the longest title kept, in characters.
+	titleMaxLen = 60
+	// titleExcerptLen is how much of the prompt and answer the engine sees.
+	titleExcerptLen = 2000
+)
+
+const titleSystemPrompt = "You name conversations. Reply with a title of at most six words " +
+	"that says what the conversation is about. Reply with the title only, without quotes."
+
+// Titler names chats after their first answer. Titles wait in the
+// scheduler's queues like prompts, so that they respect the engine's
+// concurrency limit.
+type Titler struct {
+	pubSub      *pubsub.PubSub
+	engines     *EngineRegistry
+	scheduler   *Scheduler
+	chatService *chat.ChatService
+	engineName  string // empty for the default engine
+	model       string // empty for the engine's model
+
+	ctx     context.Context // cancelled by Shutdown
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	running sync.WaitGroup
+	closing bool // no new titles are written
+}
+
+// NewTitler creates a Titler writing titles with the named engine of the
+// registry, or the default engine if engineName is empty. A non-empty model
+// replaces the engine's model for titles.
+func NewTitler(pubSub *pubsub.PubSub, engines *EngineRegistry, scheduler *Scheduler, chatService *chat.ChatService, engineName, model string) *Titler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Titler{
+		pubSub:      pubSub,
+		engines:     engines,
+		scheduler:   scheduler,
+		chatService: chatService,
+		engineName:  engineName,
+		model:       model,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start subscribes the titler to GenerationCompleted events.
+func (t *Titler) Start() {
+	pubsub.Subscribe(t.pubSub, func(event events.GenerationCompleted) {
+		if event.ChatID == "" {
+			return
+		}
+
+		t.mu.Lock()
+		if t.closing {
+			t.mu.Unlock()
+			return
+		}
+		t.running.Add(1)
+		t.mu.Unlock()
+		defer t.running.Done()
+
+		ctx, cancel := context.WithTimeout(t.ctx, titleTimeout)
+		defer cancel()
+
+		if err := t.title(ctx, event.ChatID, event.PromptID); err != nil {
+			log.Printf("Failed to title ChatID=%s: %v\n", event.ChatID, err)
+		}
+	})
+}
+
+// Shutdown stops writing titles and waits until the titles being written are
+// abandoned or ctx is done.
+func (t *Titler) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	t.mu.Unlock()
+	t.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// title renames a chat after its first exchange, if the completed prompt is
+// the chat's first and was answered for the first time, unless the user
+// named the chat.
+func (t *Titler) title(ctx context.Context, chatID, promptID string) error {
+	// The chat service may still be storing the answer
+	if err := t.chatService.WaitForEvents(ctx); err != nil {
+		return err
+	}
+	c, err := t.chatService.GetChat(chatID)
+	if err != nil {
+		return err
+	}
+	prompts := c.Prompts()
+	if len(prompts) == 0 || prompts[0].Id() != promptID || len(prompts[0].Responses()) != 1 {
+		return nil
+	}
+	if !autoNamed(c.Name(), prompts[0].Text()) {
+		return nil
+	}
+	answer := prompts[0].Responses()[0].Text()
+	if answer == "" {
+		return nil
+	}
+
+	engineName, engine, err := t.engine()
+	if err != nil {
+		return err
+	}
+
+	titleID := "title-" + chatID
+	release, err := t.scheduler.Acquire(ctx, engineName, chatID, titleID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	temperature, maxTokens := 0.2, 24
+	messages := []Message{
+		{Role: RoleSystem, Content: titleSystemPrompt},
+		{Role: RoleUser, Content: fmt.Sprintf("User: %s\n\nAssistant: %s",
+			excerpt(prompts[0].Text(), titleExcerptLen), excerpt(answer, titleExcerptLen))},
+	}
+	tokens, err := engine.GenerateTokens(ctx, titleID, messages, GenerateOptions{
+		Model:       t.model,
+		Temperature: &temperature,
+		MaxTokens:   &maxTokens,
+	})
+	if err != nil {
+		return err
+	}
+
+	var text strings.Builder
+	for token := range tokens {
+		if token.Err != nil {
+			return token.Err
+		}
+		text.WriteString(token.Text)
+	}
+
+	title := cleanTitle(text.String())
+	if title == "" {
+		return fmt.Errorf("engine returned no title")
+	}
+
+	// The user may have renamed the chat while the title was written
+	c, err = t.chatService.GetChat(chatID)
+	if err != nil {
+		return err
+	}
+	if !autoNamed(c.Name(), prompts[0].Text()) {
+		return nil
+	}
+	return t.chatService.RenameChat(chatID, title)
+}
+
+// autoNamed reports whether a chat still has the name it was given
+// automatically, which a title may replace, rather than one the user chose.
+func autoNamed(name, firstPrompt string) bool {
+	return name == chat.NameFromPrompt(firstPrompt) || name == chat.UntitledName
+}
+
+// engine returns the engine titles are written with and its name.
+func (t *Titler) engine() (string, LLMEngineType, error) {
+	if t.engineName != "" {
+		engine, err := t.engines.Get(t.engineName)
+		return t.engineName, engine, err
+	}
+	return t.engines.Default()
+}
+
+// cleanTitle keeps the first line of a generated title without the quotes,
+// labels and final punctuation models like to add.
+func cleanTitle(text string) string {
+	title := strings.TrimSpace(text)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = title[:i]
+	}
+	title = strings.TrimPrefix(title, "Title:")
+	title = strings.Trim(title, " \t\"'`*#.")
+	return excerpt(title, titleMaxLen)
+}
+
+// excerpt shortens text to at most n characters, marking the cut with an ellipsis.
+func excerpt(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
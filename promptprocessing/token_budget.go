@@ -0,0 +1,173 @@
+package promptprocessing
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// DefaultContextLimit is assumed for models whose context window is neither
+// configured, reported by their engine nor listed in ContextLimits.
+const DefaultContextLimit = 8192
+
+// ContextLimits maps model families to the size of their context window in tokens.
+// Models are looked up by their name without the tag, e.g. "llama3.1" for "llama3.1:8b".
+var ContextLimits = map[string]int{
+	"llama3":    8192,
+	"llama3.1":  131072,
+	"llama3.2":  131072,
+	"llama2":    4096,
+	"mistral":   32768,
+	"mixtral":   32768,
+	"gemma2":    8192,
+	"phi3":      4096,
+	"qwen2.5":   32768,
+	"codellama": 16384,
+}
+
+// DefaultAnswerReserve is kept free in the context window for the model's
+// reply when the request does not limit its length.
+const DefaultAnswerReserve = 1024
+
+// tokensPerMessage approximates the role and separator tokens each message adds.
+const tokensPerMessage = 4
+
+// ContextSizer is implemented by engines that can tell the context window
+// size of a model they serve.
+type ContextSizer interface {
+	ContextLimit(ctx context.Context, model string) (int, error)
+}
+
+// Truncation describes what a TokenBudget did to fit a conversation.
+type Truncation struct {
+	ContextLimit    int
+	PromptTokens    int
+	DroppedMessages int
+	DroppedTokens   int
+}
+
+// TokenBudget counts tokens and trims conversations to fit a model's context window.
+type TokenBudget struct {
+	encoding atomic.Pointer[tiktoken.Tiktoken]
+
+	mu     sync.RWMutex
+	limits map[string]int // configured context window sizes by model or family
+}
+
+// NewTokenBudget creates a TokenBudget using the cl100k_base encoding. The
+// encoding is loaded in the background since it may have to be downloaded;
+// until it is available, or if it cannot be loaded, token counts are
+// estimated from the text length.
+func NewTokenBudget() *TokenBudget {
+	b := &TokenBudget{}
+	go func() {
+		encoding, err := tiktoken.GetEncoding("cl100k_base")
+		if err != nil {
+			log.Printf("Failed to load tiktoken encoding, estimating token counts: %v", err)
+			return
+		}
+		b.encoding.Store(encoding)
+	}()
+	return b
+}
+
+// SetContextLimits sets the context window sizes of models, keyed by their
+// name such as "llama3.1:8b" or their family such as "llama3.1". They take
+// precedence over the sizes reported by the engines and ContextLimits.
+func (b *TokenBudget) SetContextLimits(limits map[string]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.limits = limits
+}
+
+// ContextLimit returns the context window size of a model the engine
+// generates with: the configured size of the model or its family, else the
+// size the engine reports, else that of its family in ContextLimits.
+func (b *TokenBudget) ContextLimit(ctx context.Context, engine LLMEngineType, model string) int {
+	family, _, _ := strings.Cut(model, ":")
+
+	b.mu.RLock()
+	limit, ok := b.limits[model]
+	if !ok {
+		limit, ok = b.limits[family]
+	}
+	b.mu.RUnlock()
+	if ok {
+		return limit
+	}
+
+	if sizer, ok := engine.(ContextSizer); ok {
+		limit, err := sizer.ContextLimit(ctx, model)
+		if err == nil && limit > 0 {
+			return limit
+		}
+		if err != nil {
+			log.Printf("Failed to get the context size of %s, using a default: %v", model, err)
+		}
+	}
+
+	if limit, ok := ContextLimits[family]; ok {
+		return limit
+	}
+	return DefaultContextLimit
+}
+
+// Count returns the number of tokens in text.
+func (b *TokenBudget) Count(text string) int {
+	encoding := b.encoding.Load()
+	if encoding == nil {
+		return (utf8.RuneCountInString(text) + 3) / 4
+	}
+	return len(encoding.EncodeOrdinary(text))
+}
+
+// Fit drops the oldest turns of a conversation until it fits a context window
+// of contextLimit tokens with reserve tokens left for the reply. Leading
+// system messages and the latest message are always kept.
+func (b *TokenBudget) Fit(contextLimit, reserve int, messages []Message) ([]Message, Truncation) {
+	truncation := Truncation{ContextLimit: contextLimit}
+	budget := contextLimit - reserve
+
+	counts := make([]int, len(messages))
+	for i, message := range messages {
+		counts[i] = b.Count(message.Content) + tokensPerMessage
+		truncation.PromptTokens += counts[i]
+	}
+
+	// Messages between the system prompt and the latest message may be dropped
+	first := 0
+	for first < len(messages)-1 && messages[first].Role == RoleSystem {
+		first++
+	}
+	last := len(messages) - 1
+
+	drop := first
+	for truncation.PromptTokens > budget && drop < last {
+		// Drop a whole turn so the conversation still alternates user and assistant
+		end := drop + 1
+		if messages[drop].Role == RoleUser && end < last && messages[end].Role == RoleAssistant {
+			end++
+		}
+		for i := drop; i < end; i++ {
+			truncation.PromptTokens -= counts[i]
+			truncation.DroppedTokens += counts[i]
+			truncation.DroppedMessages++
+		}
+		drop = end
+	}
+
+	if truncation.DroppedMessages == 0 {
+		return messages, truncation
+	}
+
+	fitted := make([]Message, 0, len(messages)-truncation.DroppedMessages)
+	fitted = append(fitted, messages[:first]...)
+	fitted = append(fitted, messages[drop:]...)
+	return fitted, truncation
+}
@@ -0,0 +1,87 @@
+package promptprocessing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// sizedEngine is a FakeEngine that reports the context window of its models.
+type sizedEngine struct {
+	*FakeEngine
+	limit int
+	err   error
+}
+
+func (e sizedEngine) ContextLimit(ctx context.Context, model string) (int, error) {
+	return e.limit, e.err
+}
+
+func TestContextLimit(t *testing.T) {
+	configured := map[string]int{"llama3.1:8b": 1000, "mistral": 2000}
+	tests := []struct {
+		name   string
+		engine LLMEngineType
+		model  string
+		want   int
+	}{
+		{"configured model", sizedEngine{NewFakeEngine("m"), 5000, nil}, "llama3.1:8b", 1000},
+		{"configured family", sizedEngine{NewFakeEngine("m"), 5000, nil}, "mistral:7b", 2000},
+		{"reported by the engine", sizedEngine{NewFakeEngine("m"), 5000, nil}, "llama3.1:70b", 5000},
+		{"engine fails to report", sizedEngine{NewFakeEngine("m"), 0, errors.New("unreachable")}, "llama3.1:70b", ContextLimits["llama3.1"]},
+		{"engine cannot report", NewFakeEngine("m"), "llama2:7b", ContextLimits["llama2"]},
+		{"unknown model", NewFakeEngine("m"), "unknown", DefaultContextLimit},
+	}
+
+	b := &TokenBudget{}
+	b.SetContextLimits(configured)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.ContextLimit(context.Background(), tt.engine, tt.model); got != tt.want {
+				t.Errorf("ContextLimit(%q) = %d, want %d", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitKeepsReserveForTheReply(t *testing.T) {
+	// Without an encoding a message of 396 characters counts 99+4 tokens
+	turn := strings.Repeat("a", 396)
+	messages := []Message{
+		{Role: RoleSystem, Content: "system"},
+		{Role: RoleUser, Content: turn},
+		{Role: RoleAssistant, Content: turn},
+		{Role: RoleUser, Content: turn},
+		{Role: RoleAssistant, Content: turn},
+		{Role: RoleUser, Content: "latest"},
+	}
+	maxTokens := func(n int) *int { return &n }
+
+	tests := []struct {
+		name        string
+		opts        GenerateOptions
+		wantDropped int
+	}{
+		// 1024 of 1400 tokens leave room for the system prompt, the latest message and one turn
+		{"default reserve", GenerateOptions{}, 2},
+		{"small reply", GenerateOptions{MaxTokens: maxTokens(64)}, 0},
+		{"reply as large as the window", GenerateOptions{MaxTokens: maxTokens(1400)}, 4},
+	}
+
+	b := &TokenBudget{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fitted, truncation := b.Fit(1400, tt.opts.answerReserve(), messages)
+			if truncation.DroppedMessages != tt.wantDropped {
+				t.Fatalf("dropped %d messages, want %d", truncation.DroppedMessages, tt.wantDropped)
+			}
+			if len(fitted) != len(messages)-tt.wantDropped {
+				t.Fatalf("kept %d messages, want %d", len(fitted), len(messages)-tt.wantDropped)
+			}
+			if fitted[0].Role != RoleSystem || fitted[len(fitted)-1].Content != "latest" {
+				t.Errorf("fitted conversation %v lost the system prompt or the latest message", fitted)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+// OverflowPolicy decides what happens when an ordered subscriber's buffer is full.
+type OverflowPolicy int
+
+const (
+	// Block makes Publish wait until the subscriber has room.
+	Block OverflowPolicy = iota
+	// DropOldest discards the oldest queued event to make room.
+	DropOldest
+	// DropNewest discards the event being published.
+	DropNewest
+	// Disconnect removes the subscriber.
+	Disconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultBufferSize is the queue size of an ordered subscriber unless overridden.
+const DefaultBufferSize = 100
+
+// Option configures a subscription.
+type Option func(*options)
+
+type options struct {
+	ordered    bool
+	bufferSize int
+	policy     OverflowPolicy
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		bufferSize: DefaultBufferSize,
+		policy:     Block,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.bufferSize < 1 {
+		o.bufferSize = 1
+	}
+	return o
+}
+
+// Ordered gives the subscriber its own queue so it receives events one at a
+// time, in the order they were published.
+func Ordered() Option {
+	return func(o *options) {
+		o.ordered = true
+	}
+}
+
+// WithBufferSize sets the queue size of an ordered subscriber.
+func WithBufferSize(size int) Option {
+	return func(o *options) {
+		o.ordered = true
+		o.bufferSize = size
+	}
+}
+
+// WithOverflowPolicy sets what happens when an ordered subscriber's queue is full.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(o *options) {
+		o.ordered = true
+		o.policy = policy
+	}
+}
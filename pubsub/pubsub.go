@@ -1,6 +1,7 @@
 package pubsub
 
 import (
+	"context"
 	"log"
 	"sync"
 )
@@ -8,44 +9,269 @@ import (
 // Subscriber defines the callback function signature for subscribers.
 type Subscriber func(payload interface{})
 
+// Subscription is a handle to a registered subscriber.
+type Subscription struct {
+	ps         *PubSub
+	id         uint64
+	eventTypes []string
+	subscriber Subscriber
+	opts       options
+	queue      chan interface{}
+	flushes    chan flushRequest // flush requests taken out of a full queue
+	done       chan struct{}
+	once       sync.Once
+}
+
+// EventTypes returns the event types the subscription listens to.
+func (s *Subscription) EventTypes() []string {
+	return s.eventTypes
+}
+
+// Done returns a channel that is closed once the subscription is removed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Unsubscribe removes the subscriber. It is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.ps.unsubscribe(s.eventTypes, s.id)
+		close(s.done)
+	})
+}
+
+// deliver hands the payload to the subscriber, either on a new goroutine or
+// through its queue according to the overflow policy.
+func (s *Subscription) deliver(payload interface{}) {
+	if s.queue == nil {
+		go s.subscriber(payload)
+		return
+	}
+
+	select {
+	case <-s.done:
+		return
+	case s.queue <- payload:
+		return
+	default:
+	}
+
+	switch s.opts.policy {
+	case Block:
+		select {
+		case s.queue <- payload:
+		case <-s.done:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.queue <- payload:
+				return
+			case <-s.done:
+				return
+			default:
+			}
+			select {
+			case oldest := <-s.queue:
+				if flushed, ok := oldest.(flushRequest); ok {
+					// Flush requests are never dropped
+					s.handOver(flushed)
+					continue
+				}
+				log.Printf("Subscriber of %v is full, dropped oldest event\n", s.eventTypes)
+			default:
+			}
+		}
+	case DropNewest:
+		log.Printf("Subscriber of %v is full, dropped newest event\n", s.eventTypes)
+	case Disconnect:
+		log.Printf("Subscriber of %v is full, disconnecting\n", s.eventTypes)
+		s.Unsubscribe()
+	}
+}
+
+// flushRequest is queued by Flush and closed once the subscriber reaches it.
+type flushRequest chan struct{}
+
+// handOver passes a flush request taken out of the queue to run. The events
+// queued before it were already taken by run, so it is complete once run is
+// done with the event it is handling.
+func (s *Subscription) handOver(flushed flushRequest) {
+	go func() {
+		select {
+		case s.flushes <- flushed:
+		case <-s.done:
+		}
+	}()
+}
+
+// Flush waits until an ordered subscriber has handled every event queued so
+// far. It returns immediately for unordered subscribers, whose events are not
+// queued, and once the subscription is removed. The flush request is queued
+// behind those events whatever the overflow policy, which never drops it.
+// A ctx that is already done fails the flush without queueing anything.
+func (s *Subscription) Flush(ctx context.Context) error {
+	if s.queue == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	flushed := make(flushRequest)
+	select {
+	case s.queue <- flushed:
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run delivers queued events to an ordered subscriber until it is removed.
+func (s *Subscription) run() {
+	for {
+		select {
+		case payload := <-s.queue:
+			if flushed, ok := payload.(flushRequest); ok {
+				close(flushed)
+				continue
+			}
+			s.subscriber(payload)
+		case flushed := <-s.flushes:
+			close(flushed)
+		case <-s.done:
+			return
+		}
+	}
+}
+
 // PubSub is an in-memory publish-subscribe system.
 type PubSub struct {
 	mu          sync.RWMutex
-	subscribers map[string][]Subscriber
+	nextID      uint64
+	subscribers map[string][]*Subscription
 }
 
 // NewPubSub creates a new PubSub instance.
 func NewPubSub() *PubSub {
 	return &PubSub{
-		subscribers: make(map[string][]Subscriber),
+		subscribers: make(map[string][]*Subscription),
 	}
 }
 
-// Subscribe registers a subscriber to a specific event type.
-func (ps *PubSub) Subscribe(eventType string, subscriber Subscriber) {
+// Subscribe registers a subscriber to a specific event type and returns a
+// handle that removes it. By default every event is delivered on its own
+// goroutine; pass Ordered to receive events in publish order instead.
+func (ps *PubSub) Subscribe(eventType string, subscriber Subscriber, opts ...Option) *Subscription {
+	return ps.SubscribeEvents([]string{eventType}, subscriber, opts...)
+}
+
+// SubscribeEvents registers one subscriber to several event types. An ordered
+// subscriber shares a single queue across them, so events of different types
+// from the same publisher are also received in publish order.
+func (ps *PubSub) SubscribeEvents(eventTypes []string, subscriber Subscriber, opts ...Option) *Subscription {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
-	if _, exists := ps.subscribers[eventType]; !exists {
-		ps.subscribers[eventType] = []Subscriber{}
+	ps.nextID++
+	sub := &Subscription{
+		ps:         ps,
+		id:         ps.nextID,
+		eventTypes: eventTypes,
+		subscriber: subscriber,
+		opts:       newOptions(opts),
+		done:       make(chan struct{}),
 	}
-	ps.subscribers[eventType] = append(ps.subscribers[eventType], subscriber)
+	if sub.opts.ordered {
+		sub.queue = make(chan interface{}, sub.opts.bufferSize)
+		sub.flushes = make(chan flushRequest)
+		go sub.run()
+	}
+
+	for _, eventType := range eventTypes {
+		ps.subscribers[eventType] = append(ps.subscribers[eventType], sub)
+	}
+	return sub
 }
 
-// Publish broadcasts an event to all subscribers of the given event type.
-func (ps *PubSub) Publish(eventType string, payload interface{}) {
+// SubscribeContext registers a subscriber to a specific event type and
+// removes it once ctx is done.
+func (ps *PubSub) SubscribeContext(ctx context.Context, eventType string, subscriber Subscriber, opts ...Option) *Subscription {
+	return ps.SubscribeEventsContext(ctx, []string{eventType}, subscriber, opts...)
+}
+
+// SubscribeEventsContext registers one subscriber to several event types and
+// removes it once ctx is done.
+func (ps *PubSub) SubscribeEventsContext(ctx context.Context, eventTypes []string, subscriber Subscriber, opts ...Option) *Subscription {
+	sub := ps.SubscribeEvents(eventTypes, subscriber, opts...)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Unsubscribe()
+		case <-sub.Done():
+		}
+	}()
+	return sub
+}
+
+func (ps *PubSub) unsubscribe(eventTypes []string, id uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for _, eventType := range eventTypes {
+		subs := ps.subscribers[eventType]
+		for i, sub := range subs {
+			if sub.id == id {
+				ps.subscribers[eventType] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(ps.subscribers[eventType]) == 0 {
+			delete(ps.subscribers, eventType)
+		}
+	}
+}
+
+// SubscriberCount returns the number of active subscribers for an event type.
+func (ps *PubSub) SubscriberCount(eventType string) int {
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
 
-	subscribers, exists := ps.subscribers[eventType]
-	if !exists {
-		return
+	return len(ps.subscribers[eventType])
+}
+
+// SubscriberCounts returns the number of active subscribers per event type.
+func (ps *PubSub) SubscriberCounts() map[string]int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	counts := make(map[string]int, len(ps.subscribers))
+	for eventType, subs := range ps.subscribers {
+		counts[eventType] = len(subs)
 	}
+	return counts
+}
+
+// Publish broadcasts an event to all subscribers of the given event type.
+// Ordered subscribers receive events from a single publisher in the order
+// they were published.
+func (ps *PubSub) Publish(eventType string, payload interface{}) {
+	ps.mu.RLock()
+	subscribers := append([]*Subscription(nil), ps.subscribers[eventType]...)
+	ps.mu.RUnlock()
 
-	for _, subscriber := range subscribers {
-		go func(sub Subscriber) {
-			sub(payload)
-		}(subscriber)
+	for _, sub := range subscribers {
+		sub.deliver(payload)
 	}
 }
 
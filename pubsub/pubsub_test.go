@@ -0,0 +1,427 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the payloads delivered to a subscriber.
+type recorder struct {
+	mu       sync.Mutex
+	payloads []interface{}
+}
+
+func (r *recorder) subscriber(payload interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.payloads = append(r.payloads, payload)
+}
+
+func (r *recorder) received() []interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]interface{}(nil), r.payloads...)
+}
+
+// isClosed reports whether ch is closed, waiting a little for it.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestUnsubscribeStopsDelivery(t *testing.T) {
+	ps := NewPubSub()
+	var r recorder
+	sub := ps.Subscribe("event", r.subscriber, Ordered())
+
+	ps.Publish("event", 1)
+	if err := sub.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	sub.Unsubscribe()
+	ps.Publish("event", 2)
+
+	if got := r.received(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("received %v, want only the event published before Unsubscribe", got)
+	}
+	if count := ps.SubscriberCount("event"); count != 0 {
+		t.Errorf("SubscriberCount = %d after Unsubscribe, want 0", count)
+	}
+	if !isClosed(sub.Done()) {
+		t.Error("Done is not closed after Unsubscribe")
+	}
+
+	// A second call is a no-op
+	sub.Unsubscribe()
+}
+
+func TestUnsubscribeKeepsOtherSubscribers(t *testing.T) {
+	ps := NewPubSub()
+	var first, second recorder
+	sub := ps.Subscribe("event", first.subscriber, Ordered())
+	other := ps.Subscribe("event", second.subscriber, Ordered())
+
+	sub.Unsubscribe()
+	ps.Publish("event", 1)
+	if err := other.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if got := first.received(); len(got) != 0 {
+		t.Errorf("removed subscriber received %v", got)
+	}
+	if got := second.received(); len(got) != 1 {
+		t.Errorf("remaining subscriber received %v, want one event", got)
+	}
+	if count := ps.SubscriberCount("event"); count != 1 {
+		t.Errorf("SubscriberCount = %d, want 1", count)
+	}
+}
+
+func TestSubscribeEventsCountsEveryType(t *testing.T) {
+	ps := NewPubSub()
+	sub := ps.SubscribeEvents([]string{"a", "b"}, func(interface{}) {})
+	ps.Subscribe("b", func(interface{}) {})
+
+	counts := ps.SubscriberCounts()
+	if counts["a"] != 1 || counts["b"] != 2 {
+		t.Errorf("SubscriberCounts = %v, want a:1 b:2", counts)
+	}
+
+	sub.Unsubscribe()
+	counts = ps.SubscriberCounts()
+	if _, ok := counts["a"]; ok || counts["b"] != 1 {
+		t.Errorf("SubscriberCounts = %v after Unsubscribe, want b:1 only", counts)
+	}
+}
+
+func TestSubscribeContextUnsubscribesWhenDone(t *testing.T) {
+	ps := NewPubSub()
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := ps.SubscribeContext(ctx, "event", func(interface{}) {})
+
+	cancel()
+	if !isClosed(sub.Done()) {
+		t.Fatal("Done is not closed after the context was cancelled")
+	}
+	if count := ps.SubscriberCount("event"); count != 0 {
+		t.Errorf("SubscriberCount = %d, want 0", count)
+	}
+}
+
+// gatedSubscriber blocks in the subscriber until released, so events pile up
+// in the queue of an ordered subscription.
+type gatedSubscriber struct {
+	recorder
+	started chan struct{} // receives once per delivered event
+	gate    chan struct{}
+}
+
+func newGatedSubscriber() *gatedSubscriber {
+	return &gatedSubscriber{
+		started: make(chan struct{}, 100),
+		gate:    make(chan struct{}),
+	}
+}
+
+func (g *gatedSubscriber) subscriber(payload interface{}) {
+	g.started <- struct{}{}
+	<-g.gate
+	g.recorder.subscriber(payload)
+}
+
+// fill publishes 0 and waits until the subscriber is handling it, then
+// publishes 1 to size to fill a queue of that size.
+func (g *gatedSubscriber) fill(t *testing.T, ps *PubSub, size int) {
+	t.Helper()
+
+	ps.Publish("event", 0)
+	select {
+	case <-g.started:
+	case <-time.After(time.Second):
+		t.Fatal("subscriber did not receive the first event")
+	}
+	for i := 1; i <= size; i++ {
+		ps.Publish("event", i)
+	}
+}
+
+func (g *gatedSubscriber) release() {
+	close(g.gate)
+}
+
+func TestOrderedDeliveryUnderConcurrentPublishers(t *testing.T) {
+	const publishers, perPublisher = 8, 200
+
+	type event struct{ publisher, seq int }
+	ps := NewPubSub()
+	var r recorder
+	sub := ps.Subscribe("event", r.subscriber, WithBufferSize(4))
+
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 0; seq < perPublisher; seq++ {
+				ps.Publish("event", event{p, seq})
+			}
+		}()
+	}
+	wg.Wait()
+	if err := sub.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	next := make([]int, publishers)
+	for _, payload := range r.received() {
+		e := payload.(event)
+		if e.seq != next[e.publisher] {
+			t.Fatalf("publisher %d: received event %d, want %d", e.publisher, e.seq, next[e.publisher])
+		}
+		next[e.publisher]++
+	}
+	for p, n := range next {
+		if n != perPublisher {
+			t.Errorf("publisher %d: received %d events, want %d", p, n, perPublisher)
+		}
+	}
+}
+
+func TestOrderedDeliveryAcrossEventTypes(t *testing.T) {
+	ps := NewPubSub()
+	var r recorder
+	sub := ps.SubscribeEvents([]string{"a", "b"}, r.subscriber, Ordered())
+
+	for i := 0; i < 100; i++ {
+		ps.Publish([]string{"a", "b"}[i%2], i)
+	}
+	if err := sub.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	for i, payload := range r.received() {
+		if payload != i {
+			t.Fatalf("event %d is %v, want events in publish order", i, payload)
+		}
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	const size = 2
+	tests := []struct {
+		policy OverflowPolicy
+		want   []interface{}
+	}{
+		{DropOldest, []interface{}{0, 2, 3}},
+		{DropNewest, []interface{}{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			ps := NewPubSub()
+			g := newGatedSubscriber()
+			sub := ps.Subscribe("event", g.subscriber, WithBufferSize(size), WithOverflowPolicy(tt.policy))
+			g.fill(t, ps, size)
+
+			// The queue is full, so this one overflows
+			ps.Publish("event", size+1)
+			g.release()
+			if err := sub.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+
+			got := g.received()
+			if len(got) != len(tt.want) {
+				t.Fatalf("received %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("received %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOverflowBlockWaitsForRoom(t *testing.T) {
+	const size = 2
+	ps := NewPubSub()
+	g := newGatedSubscriber()
+	sub := ps.Subscribe("event", g.subscriber, WithBufferSize(size), WithOverflowPolicy(Block))
+	g.fill(t, ps, size)
+
+	published := make(chan struct{})
+	go func() {
+		ps.Publish("event", size+1)
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("Publish returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.release()
+	if !isClosed(published) {
+		t.Fatal("Publish did not return once the subscriber caught up")
+	}
+	if err := sub.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := g.received(); len(got) != size+2 {
+		t.Errorf("received %v, want every event", got)
+	}
+}
+
+func TestOverflowBlockReturnsOnUnsubscribe(t *testing.T) {
+	ps := NewPubSub()
+	g := newGatedSubscriber()
+	defer g.release()
+	sub := ps.Subscribe("event", g.subscriber, WithBufferSize(1), WithOverflowPolicy(Block))
+	g.fill(t, ps, 1)
+
+	published := make(chan struct{})
+	go func() {
+		ps.Publish("event", 2)
+		close(published)
+	}()
+	sub.Unsubscribe()
+	if !isClosed(published) {
+		t.Fatal("Publish stayed blocked on a removed subscriber")
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	const size = 2
+	ps := NewPubSub()
+	g := newGatedSubscriber()
+	defer g.release()
+	sub := ps.Subscribe("event", g.subscriber, WithBufferSize(size), WithOverflowPolicy(Disconnect))
+	g.fill(t, ps, size)
+
+	ps.Publish("event", size+1)
+	if !isClosed(sub.Done()) {
+		t.Fatal("subscriber was not disconnected when its queue overflowed")
+	}
+	if count := ps.SubscriberCount("event"); count != 0 {
+		t.Errorf("SubscriberCount = %d, want 0", count)
+	}
+}
+
+func TestFlushWaitsForQueuedEvents(t *testing.T) {
+	const size = 3
+	ps := NewPubSub()
+	g := newGatedSubscriber()
+	sub := ps.Subscribe("event", g.subscriber, WithBufferSize(size+1))
+	g.fill(t, ps, size)
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- sub.Flush(context.Background())
+	}()
+	select {
+	case err := <-flushed:
+		t.Fatalf("Flush returned %v before the queued events were handled", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.release()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Flush did not return once the events were handled")
+	}
+	if got := g.received(); len(got) != size+1 {
+		t.Errorf("received %v when Flush returned, want every event", got)
+	}
+}
+
+func TestFlushWithExpiredContext(t *testing.T) {
+	ps := NewPubSub()
+	var r recorder
+	sub := ps.Subscribe("event", r.subscriber, Ordered())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The queue has room, yet a done context never queues the flush
+	for i := 0; i < 100; i++ {
+		if err := sub.Flush(ctx); err != context.Canceled {
+			t.Fatalf("Flush = %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+func TestFlushTimesOutOnBusySubscriber(t *testing.T) {
+	ps := NewPubSub()
+	g := newGatedSubscriber()
+	defer g.release()
+	sub := ps.Subscribe("event", g.subscriber, Ordered())
+	g.fill(t, ps, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sub.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Flush = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFlushIsNeverDropped(t *testing.T) {
+	ps := NewPubSub()
+	g := newGatedSubscriber()
+	sub := ps.Subscribe("event", g.subscriber, WithBufferSize(1), WithOverflowPolicy(DropOldest))
+	g.fill(t, ps, 0)
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- sub.Flush(context.Background())
+	}()
+	// Wait for the flush request to fill the queue, then push it out
+	deadline := time.Now().Add(time.Second)
+	for len(sub.queue) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	ps.Publish("event", 1)
+
+	g.release()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Flush never returned after its request was pushed out of the queue")
+	}
+}
+
+func TestFlushUnordered(t *testing.T) {
+	ps := NewPubSub()
+	sub := ps.Subscribe("event", func(interface{}) {})
+
+	if err := sub.Flush(context.Background()); err != nil {
+		t.Errorf("Flush = %v, want nil for an unordered subscriber", err)
+	}
+}
+
+func TestFlushAfterUnsubscribe(t *testing.T) {
+	ps := NewPubSub()
+	g := newGatedSubscriber()
+	defer g.release()
+	sub := ps.Subscribe("event", g.subscriber, Ordered())
+	g.fill(t, ps, 1)
+
+	sub.Unsubscribe()
+	if err := sub.Flush(context.Background()); err != nil {
+		t.Errorf("Flush = %v, want nil for a removed subscriber", err)
+	}
+}
@@ -0,0 +1,42 @@
+package pubsub
+
+import (
+	"context"
+	"log"
+)
+
+// Event is a typed payload that knows the name it is published under.
+type Event interface {
+	EventName() string
+}
+
+// Publish broadcasts a typed event to the subscribers of its name.
+func Publish[T Event](ps *PubSub, event T) {
+	ps.Publish(event.EventName(), event)
+}
+
+// Subscribe registers a subscriber for events of type T. Payloads of any
+// other type published under the same name are logged and skipped.
+func Subscribe[T Event](ps *PubSub, subscriber func(T), opts ...Option) *Subscription {
+	var zero T
+	return ps.Subscribe(zero.EventName(), typed(subscriber), opts...)
+}
+
+// SubscribeContext registers a subscriber for events of type T and removes it
+// once ctx is done.
+func SubscribeContext[T Event](ctx context.Context, ps *PubSub, subscriber func(T), opts ...Option) *Subscription {
+	var zero T
+	return ps.SubscribeContext(ctx, zero.EventName(), typed(subscriber), opts...)
+}
+
+func typed[T Event](subscriber func(T)) Subscriber {
+	return func(payload interface{}) {
+		event, ok := payload.(T)
+		if !ok {
+			var zero T
+			log.Printf("Invalid payload for %s event: %T\n", zero.EventName(), payload)
+			return
+		}
+		subscriber(event)
+	}
+}